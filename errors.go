@@ -3,6 +3,7 @@
 package main
 
 import (
+	"encoding/json"
 	"log/slog"
 	"net/http"
 )
@@ -16,14 +17,46 @@ func (e Error) Error() string {
 }
 
 const (
-	ErrFailedRollback Error = "failed rollback"
-	ErrInvalidIP      Error = "invalid IP"
-	ErrInvalidURL     Error = "invalid URL"
-	ErrMissingName    Error = "missing name"
-	ErrMissingURL     Error = "missing URL"
-	ErrMissingUser    Error = "missing user"
-	ErrNoTx           Error = "no tx"
-	ErrUnknown        Error = "unknown error"
+	ErrBodyTooLarge        Error = "body too large"
+	ErrConfigFormat        Error = "unknown config format"
+	ErrCredentialsDisabled Error = "credentials disabled"
+	ErrFailedRollback      Error = "failed rollback"
+	ErrInvalidBackup       Error = "invalid backup"
+	ErrInvalidBool         Error = "invalid boolean"
+	ErrInvalidCode         Error = "invalid redirect code"
+	ErrInvalidConfig       Error = "invalid config"
+	ErrInvalidDays         Error = "invalid days"
+	ErrInvalidExpiry       Error = "invalid expiry"
+	ErrInvalidFormat       Error = "invalid format"
+	ErrInvalidHeader       Error = "header not allowed"
+	ErrInvalidIP           Error = "invalid IP"
+	ErrInvalidMaxHits      Error = "invalid maximum hits"
+	ErrInvalidName         Error = "invalid name"
+	ErrInvalidPage         Error = "invalid page"
+	ErrInvalidPassword     Error = "invalid password"
+	ErrInvalidPath         Error = "invalid path"
+	ErrInvalidQuota        Error = "invalid quota"
+	ErrInvalidSince        Error = "invalid since"
+	ErrInvalidSort         Error = "invalid sort"
+	ErrInvalidStrategy     Error = "invalid strategy"
+	ErrInvalidTarget       Error = "invalid target"
+	ErrInvalidURL          Error = "invalid URL"
+	ErrMalformedBody       Error = "malformed body"
+	ErrMalformedForm       Error = "malformed form"
+	ErrMissingName         Error = "missing name"
+	ErrNameCollision       Error = "no free name found"
+	ErrNameTaken           Error = "name taken"
+	ErrMissingURL          Error = "missing URL"
+	ErrMissingUser         Error = "missing user"
+	ErrNoTx                Error = "no tx"
+	ErrQueryTimeout        Error = "query timeout"
+	ErrQuotaExceeded       Error = "quota exceeded"
+	ErrReservedName        Error = "reserved name"
+	ErrTargetBlocked       Error = "target blocked"
+	ErrTargetHostDenied    Error = "target host not allowed"
+	ErrURLTooLong          Error = "URL too long"
+	ErrUnknown             Error = "unknown error"
+	ErrWebhookFailed       Error = "webhook failed"
 )
 
 // HTTPError is an error returned over the network.
@@ -47,7 +80,12 @@ func (e *HTTPError) polish() {
 // ServerHTTP implements http.Handler.
 func (e *HTTPError) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	e.polish()
+	e.log(r)
 
+	http.Error(w, e.Message, e.Code)
+}
+
+func (e *HTTPError) log(r *http.Request) {
 	slog.Error("error",
 		slog.String("method", r.Method),
 		slog.String("url", r.RequestURI),
@@ -55,7 +93,27 @@ func (e *HTTPError) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 		slog.String("remote", r.RemoteAddr),
 		slog.String("message", e.Message),
 		slog.Any("err", e.Err),
+		slog.String("requestID", getRequestID(r.Context())),
 	)
+}
 
-	http.Error(w, e.Message, e.Code)
+// JSONError is an HTTPError returned as JSON: {"error": "message"}.
+type JSONError struct {
+	*HTTPError
+}
+
+// ServeHTTP implements http.Handler.
+func (e JSONError) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	e.polish()
+	e.log(r)
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(e.Code)
+
+	if err := json.NewEncoder(w).Encode(map[string]string{
+		"error": e.Message,
+	}); err != nil {
+		slog.Error("failed encoding JSON", slog.Any("err", err))
+	}
 }
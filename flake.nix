@@ -3,11 +3,10 @@
   description = "URL redirector";
 
   inputs = {
-    nixpkgs.url = "nixpkgs/nixos-23.11";
-    nixpkgs-unstable.url = "nixpkgs/nixos-unstable";
+    nixpkgs.url = "nixpkgs/nixos-24.11";
   };
 
-  outputs = { self, nixpkgs, nixpkgs-unstable }:
+  outputs = { self, nixpkgs }:
     let
       lastModifiedDate =
         self.lastModifiedDate or self.lastModified or "19700101";
@@ -15,24 +14,20 @@
       supportedSystems = [ "x86_64-linux" "aarch64-linux" ];
       forAllSystems = nixpkgs.lib.genAttrs supportedSystems;
       nixpkgsFor = forAllSystems (system: import nixpkgs { inherit system; });
-      unstableFor =
-        forAllSystems (system: import nixpkgs-unstable { inherit system; });
     in {
       packages = forAllSystems (system:
         let pkgs = nixpkgsFor.${system};
         in {
-          urlredir = pkgs.buildGoModule {
+          urlredir = pkgs.buildGo123Module {
             pname = "urlredir";
             inherit version;
             src = ./.;
-            vendorHash = "sha256-UjSRjWZVF8W09L6tJCUI5lC3oScV1UjCHoXadfArSXY=";
+            vendorHash = "sha256-RfcDPpnfWKwgTcWlHcbllwgIuyCUoMBI3IOKBCihLlA=";
           };
         });
 
       devShells = forAllSystems (system:
-        let
-          pkgs = nixpkgsFor.${system};
-          unstable = unstableFor.${system};
+        let pkgs = nixpkgsFor.${system};
         in {
           default = pkgs.mkShell {
             buildInputs = with pkgs; [
@@ -41,10 +36,8 @@
               entr
               git
               gnumake
-              unstable.go_1_22
-              (unstable.golangci-lint.override {
-                buildGoModule = unstable.buildGo122Module;
-              })
+              go_1_23
+              (golangci-lint.override { buildGoModule = buildGo123Module; })
               wget
             ];
           };
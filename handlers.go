@@ -3,18 +3,42 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"compress/gzip"
+	"compress/zlib"
 	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
 	"database/sql"
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"html/template"
+	"io"
+	"iter"
 	"log/slog"
+	"maps"
+	"math/big"
+	"mime"
 	"net"
 	"net/http"
 	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
+	"unicode"
 
 	_ "github.com/lib/pq"
+	"github.com/skip2/go-qrcode"
+	"golang.org/x/crypto/bcrypt"
 )
 
 // ctxKey is used for storing values in context.
@@ -25,6 +49,12 @@ const (
 	txKey ctxKey = iota
 	// userKey is key for user name in context.
 	userKey
+	// csrfKey is key for the CSRF token of the admin page in context.
+	csrfKey
+	// requestIDKey is key for the request ID in context.
+	requestIDKey
+	// readOnlyKey marks a read-only transaction, possibly on the replica.
+	readOnlyKey
 )
 
 // must panics if error isn't nil.
@@ -109,6 +139,221 @@ func (c chain) applyE(h errorHandler) http.Handler {
 	return c.apply(withError(h))
 }
 
+// passMiddleware passes requests on as is, in place of disabled middleware.
+func passMiddleware(next http.Handler) http.Handler {
+	return next
+}
+
+// builtMiddleware is middleware built from a config.
+type builtMiddleware struct {
+	c  *config
+	mw middleware
+}
+
+// reloadable applies the middleware built from the live config, see
+// liveConf, building it again once the config is reloaded. Handlers it is
+// applied to share the built middleware.
+func reloadable(build func(c *config) middleware) middleware {
+	var current atomic.Pointer[builtMiddleware]
+
+	get := func() middleware {
+		c := liveConf()
+
+		old := current.Load()
+		if old != nil && old.c == c {
+			return old.mw
+		}
+
+		b := &builtMiddleware{c: c, mw: build(c)}
+		if !current.CompareAndSwap(old, b) {
+			// built concurrently, use that one
+			return current.Load().mw
+		}
+
+		return b.mw
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request,
+		) {
+			get()(next).ServeHTTP(w, r)
+		})
+	}
+}
+
+// versionHandler responds with build information as JSON.
+func versionHandler(w http.ResponseWriter, _ *http.Request) error {
+	w.Header().Set("Content-Type", "application/json")
+
+	err := json.NewEncoder(w).Encode(map[string]string{
+		"gitRev":    gitRev,
+		"gitDirty":  gitDirty,
+		"revDate":   revDate.Format(time.RFC3339),
+		"goVersion": goVersion,
+	})
+	if err != nil {
+		return fmt.Errorf("failed encoding JSON: %w", err)
+	}
+
+	return nil
+}
+
+// healthzHandler reports that the process is up.
+func healthzHandler(w http.ResponseWriter, _ *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// pinger is a database that can be checked for reachability.
+type pinger interface {
+	PingContext(ctx context.Context) error
+}
+
+// readyzHandler reports whether db is reachable, giving up after
+// readyTimeout.
+func readyzHandler(db pinger) errorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx, cancel := context.WithTimeout(r.Context(), readyTimeout)
+		defer cancel()
+
+		if err := db.PingContext(ctx); err != nil {
+			return &HTTPError{
+				Code:    http.StatusServiceUnavailable,
+				Err:     err,
+				Message: "database unreachable",
+			}
+		}
+
+		fmt.Fprintln(w, "ok")
+
+		return nil
+	}
+}
+
+// routeMux is an http.ServeMux that remembers the registered patterns.
+type routeMux struct {
+	*http.ServeMux
+	patterns []string
+}
+
+// Handle registers the handler for the given pattern.
+func (m *routeMux) Handle(pattern string, handler http.Handler) {
+	m.patterns = append(m.patterns, pattern)
+	m.ServeMux.Handle(pattern, handler)
+}
+
+// routeNames returns the names that would collide with the given patterns,
+// i.e. their literal first path segments.
+func routeNames(patterns []string) []string {
+	names := []string{}
+
+	for _, pattern := range patterns {
+		_, path, _ := strings.Cut(pattern, "/")
+		first, _, _ := strings.Cut(path, "/")
+
+		if first == "" || strings.HasPrefix(first, "{") {
+			continue
+		}
+
+		names = append(names, first)
+	}
+
+	slices.Sort(names)
+
+	return slices.Compact(names)
+}
+
+// reservedHandler responds with the names that can't be used as a JSON array.
+func reservedHandler(c *config) errorHandler {
+	return func(w http.ResponseWriter, _ *http.Request) error {
+		w.Header().Set("Content-Type", "application/json")
+
+		names := slices.Concat(c.routeNames, c.ReservedNames)
+		slices.Sort(names)
+
+		if err := json.NewEncoder(w).Encode(slices.Compact(
+			names)); err != nil {
+			return fmt.Errorf("failed encoding JSON: %w", err)
+		}
+
+		return nil
+	}
+}
+
+// availableHandler responds whether the name in the query is free to use.
+func availableHandler(c *config) errorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+		tx := must(getTx(ctx))
+		name := r.URL.Query().Get("name")
+
+		if name == "" {
+			return &HTTPError{ //nolint:exhaustruct
+				Code: http.StatusBadRequest,
+				Err:  ErrMissingName,
+			}
+		}
+
+		available := validateName(name) == nil && !c.isReserved(name)
+
+		if available {
+			used, err := nameInUse(ctx, tx, name, !c.ReuseDeletedNames)
+			if err != nil {
+				return err
+			}
+
+			available = !used
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(map[string]bool{
+			"available": available,
+		}); err != nil {
+			return fmt.Errorf("failed encoding JSON: %w", err)
+		}
+
+		return nil
+	}
+}
+
+// summaryHandler responds with a JSON summary of the links of the user.
+func summaryHandler(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	tx := must(getTx(ctx))
+	user := must(getUser(ctx))
+
+	if user == "" {
+		return &HTTPError{ //nolint:exhaustruct
+			Code: http.StatusBadRequest,
+			Err:  ErrMissingUser,
+		}
+	}
+
+	s, err := userSummary(ctx, tx, user)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(s); err != nil {
+		return fmt.Errorf("failed encoding JSON: %w", err)
+	}
+
+	return nil
+}
+
+// methodNotAllowedHandler responds with 405 and lists the allowed methods.
+func methodNotAllowedHandler(allow ...string) errorHandler {
+	return func(w http.ResponseWriter, _ *http.Request) error {
+		w.Header().Set("Allow", strings.Join(allow, ", "))
+
+		//nolint:exhaustruct
+		return &HTTPError{Code: http.StatusMethodNotAllowed}
+	}
+}
+
 // parseIP returns a parsed IP address if possible.
 func parseIP(s string) (net.IP, error) {
 	inet, _, err := net.SplitHostPort(s)
@@ -130,12 +375,122 @@ func handleError(w http.ResponseWriter, err error, code int) {
 	http.Error(w, http.StatusText(code), code)
 }
 
+// statusRecorder captures the status and size of a response for logging.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+	bytes  int
+}
+
+// WriteHeader records status before passing it on.
+func (w *statusRecorder) WriteHeader(status int) {
+	if w.status == 0 {
+		w.status = status
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write counts the bytes written, implying 200 without WriteHeader.
+func (w *statusRecorder) Write(b []byte) (int, error) {
+	if w.status == 0 {
+		w.status = http.StatusOK
+	}
+
+	n, err := w.ResponseWriter.Write(b)
+	w.bytes += n
+
+	return n, err //nolint:wrapcheck
+}
+
+// Flush flushes the underlying ResponseWriter, if it supports flushing.
+func (w *statusRecorder) Flush() {
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (w *statusRecorder) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// requestIDHeader carries the request ID between the proxy, this service
+// and the client.
+const requestIDHeader = "X-Request-Id"
+
+// maxRequestIDLength limits incoming request IDs, which end up in every log
+// line of the request.
+const maxRequestIDLength = 128
+
+// requestIDSize is the number of bytes in a UUID.
+const requestIDSize = 16
+
+// newRequestID returns a random (version 4) UUID.
+func newRequestID() string {
+	b := make([]byte, requestIDSize)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	// version 4, variant 10
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10],
+		b[10:])
+}
+
+// validRequestID tells whether an incoming request ID is safe to log and
+// echo: printable ASCII without spaces, and not too long.
+func validRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLength {
+		return false
+	}
+
+	for _, c := range id {
+		if c <= ' ' || c > '~' {
+			return false
+		}
+	}
+
+	return true
+}
+
+// getRequestID returns the request ID from the context, empty if none.
+func getRequestID(ctx context.Context) string {
+	id, _ := ctx.Value(requestIDKey).(string)
+
+	return id
+}
+
+// requestIDMiddleware keeps the request ID set by a proxy, or sets a new one,
+// and echoes it in the response for correlating logs.
+func requestIDMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		id := r.Header.Get(requestIDHeader)
+		if !validRequestID(id) {
+			id = newRequestID()
+		}
+
+		w.Header().Set(requestIDHeader, id)
+
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(),
+			requestIDKey, id)))
+	})
+}
+
 // loggerMiddleware logs HTTP requests.
 func loggerMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		start := time.Now()
+		rec := &statusRecorder{ResponseWriter: w, status: 0, bytes: 0}
 
-		next.ServeHTTP(w, r)
+		next.ServeHTTP(rec, r)
+
+		if rec.status == 0 {
+			rec.status = http.StatusOK
+		}
 
 		slog.Info("req", slog.String("addr", r.RemoteAddr),
 			slog.String("method", r.Method),
@@ -143,7 +498,10 @@ func loggerMiddleware(next http.Handler) http.Handler {
 			slog.String("proto", r.Proto),
 			slog.String("referer", r.Referer()),
 			slog.String("userAgent", r.UserAgent()),
+			slog.Int("status", rec.status),
+			slog.Int("bytes", rec.bytes),
 			slog.Any("duration", time.Since(start)),
+			slog.String("requestID", getRequestID(r.Context())),
 		)
 	})
 }
@@ -187,238 +545,3694 @@ func realIPMiddleware(header string) middleware {
 	}
 }
 
-// staticUserMiddleware sets a static user name in the context, e.g. for testing.
-func staticUserMiddleware(user string) middleware {
+// canonicalHostMiddleware permanently redirects requests for other hosts to the
+// same path on the canonical host.
+func canonicalHostMiddleware(host string) middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter,
 			r *http.Request,
 		) {
-			ctx := r.Context()
-			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx,
-				userKey, user)))
+			if strings.EqualFold(r.Host, host) {
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			u := *r.URL
+			u.Host = host
+			u.Scheme = "http"
+
+			if r.TLS != nil {
+				u.Scheme = "https"
+			}
+
+			http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
 		})
 	}
 }
 
-// remoteUserMiddleware sets user name in context based on headers from proxy.
-func remoteUserMiddleware(header string) middleware {
+// hstsMiddleware sets the Strict-Transport-Security header to value on TLS
+// connections. Browsers ignore it over plain HTTP.
+func hstsMiddleware(value string) middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter,
 			r *http.Request,
 		) {
-			ctx := r.Context()
-			user := r.Header.Get(header)
-			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx,
-				userKey, user)))
+			if r.TLS != nil {
+				w.Header().Set("Strict-Transport-Security", value)
+			}
+
+			next.ServeHTTP(w, r)
 		})
 	}
 }
 
-// beginner is an interface that can start a transaction (e.g. pool and conn).
-type beginner interface {
-	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+// secretOrRandom returns secret, or a random one if it is empty.
+func secretOrRandom(secret string) []byte {
+	if secret != "" {
+		return []byte(secret)
+	}
+
+	b := make([]byte, sha256.Size)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return b
 }
 
-// dbMiddleware opens transaction in context and rollbacks if there's a panic.
-func dbMiddleware(db beginner) middleware {
+// The CSRF token of the admin page is set in a cookie and must be sent back
+// in a form field or header.
+const (
+	csrfCookieName = "urlredir-csrf"
+	csrfField      = "csrf"
+	csrfHeader     = "X-CSRF-Token"
+	csrfNonceSize  = 16
+)
+
+// csrfSignature signs nonce for user.
+func csrfSignature(key []byte, user, nonce string) string {
+	mac := hmac.New(sha256.New, key)
+	fmt.Fprintf(mac, "%s\x00%s", user, nonce)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// newCSRFToken returns a new CSRF token for user.
+func newCSRFToken(key []byte, user string) string {
+	b := make([]byte, csrfNonceSize)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	nonce := hex.EncodeToString(b)
+
+	return nonce + "." + csrfSignature(key, user, nonce)
+}
+
+// validCSRFToken tells whether token was issued for user with key.
+func validCSRFToken(key []byte, user, token string) bool {
+	nonce, sig, ok := strings.Cut(token, ".")
+	if !ok {
+		return false
+	}
+
+	return hmac.Equal([]byte(sig), []byte(csrfSignature(key, user, nonce)))
+}
+
+// getCSRFToken returns the CSRF token from the context, empty if none.
+func getCSRFToken(ctx context.Context) string {
+	token, _ := ctx.Value(csrfKey).(string)
+
+	return token
+}
+
+// csrfMiddleware protects against cross-site request forgery. Safe requests
+// get a CSRF token for the user in a cookie and in the context, others are
+// rejected unless they send back the token of the cookie or use an API token.
+// Must run after the user is set.
+func csrfMiddleware(key []byte) middleware {
 	return func(next http.Handler) http.Handler {
 		return http.HandlerFunc(func(w http.ResponseWriter,
 			r *http.Request,
 		) {
 			ctx := r.Context()
+			user := must(getUser(ctx))
 
-			tx, err := db.BeginTx(ctx, nil)
-			if err != nil {
-				panic(err)
+			var token string
+			if cookie, err := r.Cookie(csrfCookieName); err == nil &&
+				validCSRFToken(key, user, cookie.Value) {
+				token = cookie.Value
 			}
 
-			defer func() {
-				if r := recover(); r != nil {
-					err = tx.Rollback()
-					if err != nil {
-						panic(err)
+			switch r.Method {
+			case http.MethodGet, http.MethodHead, http.MethodOptions:
+				if token == "" {
+					token = newCSRFToken(key, user)
+					http.SetCookie(w, &http.Cookie{ //nolint:exhaustruct
+						Name:     csrfCookieName,
+						Value:    token,
+						Path:     "/",
+						Secure:   r.TLS != nil,
+						HttpOnly: true,
+						SameSite: http.SameSiteStrictMode,
+					})
+				}
+
+				ctx = context.WithValue(ctx, csrfKey, token)
+			default:
+				// browsers don't add API tokens to forged requests
+				if bearerToken(r) != "" {
+					break
+				}
+
+				sent := r.Header.Get(csrfHeader)
+				if sent == "" {
+					var herr *HTTPError
+					if err := parseForm(r); errors.As(err, &herr) {
+						herr.ServeHTTP(w, r)
+
+						return
 					}
 
-					panic(r)
+					sent = r.PostFormValue(csrfField)
 				}
-			}()
 
-			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx,
-				txKey, tx)))
+				if token == "" || !hmac.Equal([]byte(sent), []byte(token)) {
+					(&HTTPError{ //nolint:exhaustruct
+						Code:    http.StatusForbidden,
+						Message: "Invalid CSRF token",
+					}).ServeHTTP(w, r)
 
-			err = tx.Commit()
-			if err != nil && !errors.Is(err, sql.ErrTxDone) {
-				panic(err)
+					return
+				}
 			}
+
+			next.ServeHTTP(w, r.WithContext(ctx))
 		})
 	}
 }
 
-// redirHandler redirects if URL is found in database.
-func redirHandler(w http.ResponseWriter, r *http.Request) error {
-	ctx := r.Context()
-
-	tx := must(getTx(ctx))
-	name := r.PathValue("name")
-	agent := r.UserAgent()
-	referer := r.Referer()
+// maxRateBuckets bounds the number of clients tracked by a rateLimiter.
+const maxRateBuckets = 10000
 
-	slog.Debug("REDIR", slog.String("name", name))
+// rateLimiter is a token bucket per client IP.
+type rateLimiter struct {
+	mu      sync.Mutex
+	rps     float64
+	burst   float64
+	buckets map[string]*rateBucket
+}
 
-	var referrer *string
+// rateBucket holds the tokens of a client.
+type rateBucket struct {
+	tokens float64
+	last   time.Time
+}
 
-	if referer != "" {
-		referrer = &referer
-	}
+// allow takes a token for ip if one is available.
+func (l *rateLimiter) allow(ip string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
 
-	u, urlID, err := getURLnID(ctx, tx, name)
-	if errors.Is(err, sql.ErrNoRows) {
-		//nolint:exhaustruct
-		return &HTTPError{Code: http.StatusNotFound}
-	} else if err != nil {
-		return err
-	}
+	t := now()
 
-	// 301 seems to be the best combined with cache-control
-	w.Header().Set("Cache-Control", "private, max-age=90")
-	//nolint:mnd
-	w.Header().Set("Expires", time.Now().Add(90*time.Second).In(
-		time.UTC).Format(http.TimeFormat))
-	w.Header().Set("Content-Type", "text/html")
-	http.Redirect(w, r, u, http.StatusMovedPermanently)
+	b, ok := l.buckets[ip]
+	if !ok {
+		if len(l.buckets) >= maxRateBuckets {
+			l.evict(t)
+		}
 
-	ip, err := parseIP(r.RemoteAddr)
-	if err != nil {
-		return err
+		b = &rateBucket{tokens: l.burst, last: t}
+		l.buckets[ip] = b
 	}
 
-	if err = addHit(ctx, tx, urlID, ip, agent, referrer); err != nil {
-		return err
+	b.tokens = min(l.burst, b.tokens+t.Sub(b.last).Seconds()*l.rps)
+	b.last = t
+
+	if b.tokens < 1 {
+		return false
 	}
 
-	slog.InfoContext(ctx, "redirect", slog.String("agent", agent),
-		slog.String("referer", referer), slog.String("name", name),
-		slog.String("url", u), slog.String("remote", r.RemoteAddr))
+	b.tokens--
 
-	return nil
+	return true
 }
 
-// deleteHandler removes a specific URL if authorized.
-func deleteHandler(_ http.ResponseWriter, r *http.Request) error {
-	ctx := r.Context()
-	tx := must(getTx(ctx))
-	user := must(getUser(ctx))
-
-	if user == "" {
-		return &HTTPError{ //nolint:exhaustruct
-			Code:    http.StatusBadRequest,
-			Message: "Missing user",
+// evict forgets the clients whose buckets would be full again.
+func (l *rateLimiter) evict(t time.Time) {
+	for ip, b := range l.buckets {
+		if b.tokens+t.Sub(b.last).Seconds()*l.rps >= l.burst {
+			delete(l.buckets, ip)
 		}
 	}
+}
 
-	name := r.PathValue("name")
-
-	_, urluser, err := getIDnUser(ctx, tx, name)
-	if errors.Is(err, sql.ErrNoRows) {
-		return &HTTPError{ //nolint:exhaustruct
-			Code: http.StatusNotFound,
-			Err:  err,
-		}
-	} else if err != nil {
-		return err
+// rateLimitMiddleware limits each client IP to rps requests per second with
+// bursts of burst requests. Must come after realIPMiddleware.
+func rateLimitMiddleware(rps, burst int) middleware {
+	l := &rateLimiter{ //nolint:exhaustruct
+		rps:     float64(rps),
+		burst:   float64(burst),
+		buckets: map[string]*rateBucket{},
 	}
+	retryAfter := strconv.Itoa(max(1, 1/rps))
 
-	if user != urluser {
-		//nolint:exhaustruct
-		return &HTTPError{Code: http.StatusForbidden}
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request,
+		) {
+			ip, err := parseIP(r.RemoteAddr)
+			if err != nil {
+				handleError(w, err, http.StatusBadRequest)
+
+				return
+			}
+
+			if !l.allow(ip.String()) {
+				w.Header().Set("Retry-After", retryAfter)
+				http.Error(w, http.StatusText(http.StatusTooManyRequests),
+					http.StatusTooManyRequests)
+
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// concurrencyLimitMiddleware rejects requests from client IPs that already
+// have limit requests in flight. Must come after realIPMiddleware.
+func concurrencyLimitMiddleware(limit int) middleware {
+	var (
+		mu       sync.Mutex
+		inFlight = map[string]int{}
+	)
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request,
+		) {
+			ip, err := parseIP(r.RemoteAddr)
+			if err != nil {
+				handleError(w, err, http.StatusBadRequest)
+
+				return
+			}
+
+			key := ip.String()
+
+			mu.Lock()
+
+			if inFlight[key] >= limit {
+				mu.Unlock()
+				http.Error(w, http.StatusText(http.StatusTooManyRequests),
+					http.StatusTooManyRequests)
+
+				return
+			}
+
+			inFlight[key]++
+			mu.Unlock()
+
+			defer func() {
+				mu.Lock()
+				defer mu.Unlock()
+
+				// forget idle clients
+				if inFlight[key]--; inFlight[key] == 0 {
+					delete(inFlight, key)
+				}
+			}()
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// loggedBodyTypes are the content types of request bodies worth logging.
+//
+//nolint:gochecknoglobals
+var loggedBodyTypes = []string{
+	"application/json",
+	"application/x-www-form-urlencoded",
+	"text/plain",
+}
+
+// cappedBuffer keeps the first limit bytes written to it.
+type cappedBuffer struct {
+	limit int
+	buf   []byte
+}
+
+// Write implements io.Writer, never failing.
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	if n := b.limit - len(b.buf); n > 0 {
+		b.buf = append(b.buf, p[:min(n, len(p))]...)
+	}
+
+	return len(p), nil
+}
+
+// wantsJSON tells whether the client accepts JSON explicitly, as opposed to
+// browsers that get HTML.
+func wantsJSON(r *http.Request) bool {
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err == nil && mt == "application/json" {
+			return true
+		}
+	}
+
+	return false
+}
+
+// bodyLogMiddleware logs the first limit bytes of textual request bodies at
+// debug level. The body is copied as the handler reads it.
+func bodyLogMiddleware(limit int) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request,
+		) {
+			mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+			if !slices.Contains(loggedBodyTypes, mt) {
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			buf := &cappedBuffer{limit: limit} //nolint:exhaustruct
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.TeeReader(r.Body, buf), r.Body}
+
+			next.ServeHTTP(w, r)
+
+			slog.DebugContext(r.Context(), "request body",
+				slog.String("method", r.Method),
+				slog.String("path", r.URL.Path),
+				slog.String("body", string(buf.buf)))
+		})
+	}
+}
+
+// compressedTypes are the content types of responses worth compressing.
+// Images and archives are compressed already.
+//
+//nolint:gochecknoglobals
+var compressedTypes = []string{
+	"application/json",
+	"application/x-ndjson",
+	"text/csv",
+	"text/html",
+	"text/plain",
+}
+
+// minCompressSize is the smallest response of known length worth compressing.
+const minCompressSize = 1024
+
+// compressor is a gzip or zlib writer.
+type compressor interface {
+	io.Writer
+	Flush() error
+	Close() error
+}
+
+// negotiateEncoding returns the preferred content encoding out of gzip and
+// deflate accepted by the Accept-Encoding header, empty for none.
+func negotiateEncoding(accept string) string {
+	var gz, deflate bool
+
+	for _, part := range strings.Split(accept, ",") {
+		coding, params, _ := strings.Cut(part, ";")
+		if q, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			if v, err := strconv.ParseFloat(q, 64); err != nil || v == 0 {
+				continue
+			}
+		}
+
+		switch strings.ToLower(strings.TrimSpace(coding)) {
+		case "gzip", "x-gzip", "*":
+			gz = true
+		case "deflate":
+			deflate = true
+		}
+	}
+
+	switch {
+	case gz:
+		return "gzip"
+	case deflate:
+		return "deflate"
+	default:
+		return ""
+	}
+}
+
+// compressWriter compresses the response with encoding, if it turns out to be
+// successful, large enough and of a compressible type.
+type compressWriter struct {
+	http.ResponseWriter
+	encoding string
+	// c is the compressor, nil until the header is written and if the
+	// response is passed as is
+	c           compressor
+	wroteHeader bool
+}
+
+// WriteHeader decides whether to compress before passing status on.
+func (w *compressWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		w.ResponseWriter.WriteHeader(status)
+
+		return
+	}
+
+	w.wroteHeader = true
+	h := w.Header()
+	mt, _, _ := mime.ParseMediaType(h.Get("Content-Type"))
+	size, err := strconv.Atoi(h.Get("Content-Length"))
+
+	if status >= http.StatusOK && status < http.StatusMultipleChoices &&
+		status != http.StatusNoContent && h.Get("Content-Encoding") == "" &&
+		slices.Contains(compressedTypes, mt) &&
+		(err != nil || size >= minCompressSize) {
+		h.Set("Content-Encoding", w.encoding)
+		h.Del("Content-Length")
+
+		if w.encoding == "gzip" {
+			w.c = gzip.NewWriter(w.ResponseWriter)
+		} else {
+			w.c = zlib.NewWriter(w.ResponseWriter)
+		}
+	}
+
+	w.ResponseWriter.WriteHeader(status)
+}
+
+// Write compresses b if so decided, implying 200 without WriteHeader.
+func (w *compressWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		if w.Header().Get("Content-Type") == "" {
+			w.Header().Set("Content-Type", http.DetectContentType(b))
+		}
+
+		w.WriteHeader(http.StatusOK)
+	}
+
+	if w.c != nil {
+		return w.c.Write(b) //nolint:wrapcheck
+	}
+
+	return w.ResponseWriter.Write(b) //nolint:wrapcheck
+}
+
+// Flush sends what has been compressed so far to the client.
+func (w *compressWriter) Flush() {
+	if w.c != nil {
+		if err := w.c.Flush(); err != nil {
+			slog.Error("failed flushing compressed response",
+				slog.Any("err", err))
+		}
+	}
+
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Unwrap lets http.ResponseController reach the underlying ResponseWriter.
+func (w *compressWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+// close writes the end of the compressed stream, if any.
+func (w *compressWriter) close() error {
+	if w.c == nil {
+		return nil
+	}
+
+	return w.c.Close() //nolint:wrapcheck
+}
+
+// compressMiddleware compresses responses with gzip or deflate for clients
+// accepting them. Redirects and types compressed already are left as is.
+func compressMiddleware(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Encoding")
+
+		encoding := negotiateEncoding(r.Header.Get("Accept-Encoding"))
+		if encoding == "" || r.Method == http.MethodHead {
+			next.ServeHTTP(w, r)
+
+			return
+		}
+
+		cw := &compressWriter{ //nolint:exhaustruct
+			ResponseWriter: w,
+			encoding:       encoding,
+		}
+		defer func() {
+			if err := cw.close(); err != nil {
+				slog.Error("failed finishing compressed response",
+					slog.Any("err", err))
+			}
+		}()
+
+		next.ServeHTTP(cw, r)
+	})
+}
+
+// corsMaxAge is how long browsers may cache a preflight response, in seconds.
+const corsMaxAge = 600
+
+// allowedOrigin tells whether origin matches one of origins. An origin may be
+// *, for any, or have a *. in place of any subdomains, e.g.
+// https://*.example.com.
+func allowedOrigin(origins []string, origin string) bool {
+	origin = strings.ToLower(origin)
+
+	for _, allowed := range origins {
+		allowed = strings.ToLower(allowed)
+
+		switch {
+		case allowed == "*" || allowed == origin:
+			return true
+		case strings.Contains(allowed, "://*."):
+			scheme, domain, _ := strings.Cut(allowed, "://*")
+			if rest, ok := strings.CutPrefix(origin, scheme+"://"); ok &&
+				strings.HasSuffix(rest, domain) && len(rest) > len(domain) {
+				return true
+			}
+		}
+	}
+
+	return false
+}
+
+// corsMiddleware lets browser based clients on the allowed origins call the
+// API, answering their preflight requests. Requests from other origins are
+// rejected, same origin ones and those without an origin passed on as is.
+func corsMiddleware(origins, methods, headers []string) middleware {
+	allowMethods := strings.Join(methods, ", ")
+	allowHeaders := strings.Join(headers, ", ")
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request,
+		) {
+			origin := r.Header.Get("Origin")
+			if u, err := url.Parse(origin); origin == "" ||
+				(err == nil && strings.EqualFold(u.Host, r.Host)) {
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			w.Header().Add("Vary", "Origin")
+
+			if !allowedOrigin(origins, origin) {
+				(&HTTPError{ //nolint:exhaustruct
+					Code:    http.StatusForbidden,
+					Message: "Origin not allowed",
+				}).ServeHTTP(w, r)
+
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+
+			if r.Method != http.MethodOptions ||
+				r.Header.Get("Access-Control-Request-Method") == "" {
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			w.Header().Set("Access-Control-Allow-Methods", allowMethods)
+			w.Header().Set("Access-Control-Allow-Headers", allowHeaders)
+			w.Header().Set("Access-Control-Max-Age",
+				strconv.Itoa(corsMaxAge))
+			w.WriteHeader(http.StatusNoContent)
+		})
+	}
+}
+
+// staticUserMiddleware sets a static user name in the context, e.g. for testing.
+func staticUserMiddleware(user string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request,
+		) {
+			ctx := r.Context()
+			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx,
+				userKey, user)))
+		})
+	}
+}
+
+// remoteUserMiddleware sets user name in context based on headers from proxy.
+func remoteUserMiddleware(header string) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request,
+		) {
+			ctx := r.Context()
+			user := r.Header.Get(header)
+			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx,
+				userKey, user)))
+		})
+	}
+}
+
+// userMiddleware sets user name in context from the configured header or, if
+// there is none, to the configured default user.
+func userMiddleware(c *config) middleware {
+	if c.RemoteUserHeader != "" {
+		return remoteUserMiddleware(c.RemoteUserHeader)
+	}
+
+	return staticUserMiddleware(c.DefaultUser)
+}
+
+// apiTokenSize is the number of random bytes in an API token.
+const apiTokenSize = 32
+
+// newAPIToken returns a new random API token.
+func newAPIToken() string {
+	b := make([]byte, apiTokenSize)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(b)
+}
+
+// hashAPIToken returns the hash an API token is stored as. Tokens are random,
+// so a fast hash is enough.
+func hashAPIToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+
+	return hex.EncodeToString(sum[:])
+}
+
+// bearerToken returns the token of the Bearer Authorization header of r, empty
+// if there is none.
+func bearerToken(r *http.Request) string {
+	scheme, token, ok := strings.Cut(r.Header.Get("Authorization"), " ")
+	if !ok || !strings.EqualFold(scheme, "Bearer") {
+		return ""
+	}
+
+	return strings.TrimSpace(token)
+}
+
+// tokenAuthMiddleware sets the user name in context from a Bearer API token,
+// overriding any user set before. Unknown tokens are rejected with 401.
+// Requests without a token are passed on as is. Must run after dbMiddleware,
+// if any, see tokenUser.
+func tokenAuthMiddleware(db beginner) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request,
+		) {
+			token := bearerToken(r)
+			if token == "" {
+				next.ServeHTTP(w, r)
+
+				return
+			}
+
+			ctx := r.Context()
+
+			user, err := tokenUser(ctx, db, hashAPIToken(token))
+			if errors.Is(err, sql.ErrNoRows) {
+				w.Header().Set("WWW-Authenticate", `Bearer realm="urlredir"`)
+				(&HTTPError{ //nolint:exhaustruct
+					Code:    http.StatusUnauthorized,
+					Message: "Invalid API token",
+				}).ServeHTTP(w, r)
+
+				return
+			} else if err != nil {
+				panic(err)
+			}
+
+			next.ServeHTTP(w, r.WithContext(context.WithValue(ctx,
+				userKey, user)))
+		})
+	}
+}
+
+// tokenUser returns the user of the API token with the given hash, looked up
+// in the transaction of the request. Handlers managing their own transactions
+// get one on db just for the lookup. Uses are only recorded in writable
+// transactions.
+func tokenUser(ctx context.Context, db beginner, hash string) (string, error) {
+	if tx, err := getTx(ctx); err == nil {
+		return userForAPIToken(ctx, tx, hash, ctx.Value(readOnlyKey) == nil)
+	}
+
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return "", fmt.Errorf("failed beginning tx: %w", err)
+	}
+
+	user, err := userForAPIToken(ctx, tx, hash, true)
+	if err != nil {
+		return "", errors.Join(err, tx.Rollback())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return "", fmt.Errorf("failed committing tx: %w", err)
+	}
+
+	return user, nil
+}
+
+// beginner is an interface that can start a transaction (e.g. pool and conn).
+type beginner interface {
+	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
+}
+
+// replicaDB begins read-only transactions on a replica, falling back to the
+// primary when the replica is unavailable.
+type replicaDB struct {
+	replica, primary beginner
+}
+
+// BeginTx implements beginner.
+func (db replicaDB) BeginTx(ctx context.Context, opts *sql.TxOptions) (
+	*sql.Tx, error,
+) {
+	readOnly := sql.TxOptions{ReadOnly: true} //nolint:exhaustruct
+	if opts != nil {
+		readOnly.Isolation = opts.Isolation
+	}
+
+	tx, err := db.replica.BeginTx(ctx, &readOnly)
+	if err == nil {
+		return tx, nil
+	}
+
+	slog.WarnContext(ctx, "read replica unavailable, using primary",
+		slog.Any("err", err))
+
+	return db.primary.BeginTx(ctx, &readOnly) //nolint:wrapcheck
+}
+
+// dbMiddleware opens transaction in context and rollbacks if there's a panic.
+func dbMiddleware(db beginner) middleware {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request,
+		) {
+			ctx := r.Context()
+
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				panic(err)
+			}
+
+			defer func() {
+				if r := recover(); r != nil {
+					err = tx.Rollback()
+					if err != nil {
+						panic(err)
+					}
+
+					panic(r)
+				}
+			}()
+
+			ctx = context.WithValue(ctx, txKey, tx)
+
+			if _, ok := db.(replicaDB); ok {
+				ctx = context.WithValue(ctx, readOnlyKey, true)
+			}
+
+			next.ServeHTTP(w, r.WithContext(ctx))
+
+			err = tx.Commit()
+			if err != nil && !errors.Is(err, sql.ErrTxDone) {
+				panic(err)
+			}
+		})
+	}
+}
+
+// withFragment appends the default fragment to target unless target already
+// has a fragment of its own.
+func withFragment(target, fragment string) (string, error) {
+	if fragment == "" {
+		return target, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidURL, err)
+	}
+
+	if u.Fragment == "" {
+		u.Fragment = fragment
+	}
+
+	return u.String(), nil
+}
+
+// withQuery adds the parameters of query to target. Parameters already in
+// target take precedence.
+func withQuery(target string, query url.Values) (string, error) {
+	if len(query) == 0 {
+		return target, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", &HTTPError{ //nolint:exhaustruct
+			Code: http.StatusInternalServerError,
+			Err:  fmt.Errorf("%w: %w", ErrInvalidURL, err),
+		}
+	}
+
+	q := u.Query()
+
+	for k, vs := range query {
+		if _, ok := q[k]; !ok {
+			q[k] = vs
+		}
+	}
+
+	u.RawQuery = q.Encode()
+
+	return u.String(), nil
+}
+
+// Hit write modes, i.e. whether failing to record a hit fails the redirect.
+const (
+	hitWriteStrict     = "strict"
+	hitWriteBestEffort = "best-effort"
+)
+
+// Referrer policies for which referrers are recorded with hits.
+const (
+	referrerAll       = "all"
+	referrerCrossSite = "cross-site"
+	referrerSameSite  = "same-site"
+	referrerNone      = "none"
+)
+
+// filterReferrer returns referer if it should be recorded according to the
+// policy, comparing its host to the host of the request, otherwise "".
+func filterReferrer(policy, referer, host string) string {
+	if referer == "" || policy == "" || policy == referrerAll {
+		return referer
+	}
+
+	if policy == referrerNone {
+		return ""
+	}
+
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	u, err := url.Parse(referer)
+	sameSite := err == nil && strings.EqualFold(u.Hostname(), host)
+
+	if (policy == referrerSameSite) == sameSite {
+		return referer
+	}
+
+	return ""
+}
+
+// withCredentials injects userinfo, "user" or "user:password", to target.
+func withCredentials(target, userinfo string) (string, error) {
+	if userinfo == "" {
+		return target, nil
+	}
+
+	u, err := url.Parse(target)
+	if err != nil {
+		return "", fmt.Errorf("%w: %w", ErrInvalidURL, err)
+	}
+
+	if user, password, ok := strings.Cut(userinfo, ":"); ok {
+		u.User = url.UserPassword(user, password)
+	} else {
+		u.User = url.User(user)
+	}
+
+	return u.String(), nil
+}
+
+// redactURL returns target with any password masked for logging.
+func redactURL(target string) string {
+	u, err := url.Parse(target)
+	if err != nil {
+		return target
+	}
+
+	return u.Redacted()
+}
+
+// redirectMaxAge is how long clients may cache redirects.
+const redirectMaxAge = 90 * time.Second
+
+// setCacheHeaders lets clients cache a redirect for redirectMaxAge.
+func setCacheHeaders(h http.Header) {
+	h.Set("Cache-Control", fmt.Sprintf("private, max-age=%d",
+		int(redirectMaxAge.Seconds())))
+	h.Set("Expires", now().Add(redirectMaxAge).In(time.UTC).Format(
+		http.TimeFormat))
+}
+
+// splitResidual splits the path after a name into segments, rejecting
+// segments that could traverse out of the target path.
+func splitResidual(rest string) ([]string, error) {
+	if rest == "" {
+		return nil, nil
+	}
+
+	segments := strings.Split(rest, "/")
+
+	for _, s := range segments {
+		if s == "." || s == ".." {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidPath, rest)
+		}
+	}
+
+	return segments, nil
+}
+
+// validateName returns ErrInvalidName for names that can't be requested, i.e.
+// with whitespace or with empty, "." or ".." path segments. Slashes are fine,
+// e.g. "docs/faq" takes precedence over "docs" for "/docs/faq/top".
+func validateName(name string) error {
+	if strings.ContainsFunc(name, func(r rune) bool {
+		return unicode.IsSpace(r) || unicode.IsControl(r)
+	}) {
+		return fmt.Errorf("%w: %q", ErrInvalidName, name)
+	}
+
+	for _, s := range strings.Split(name, "/") {
+		if s == "" || s == "." || s == ".." {
+			return fmt.Errorf("%w: %q", ErrInvalidName, name)
+		}
+	}
+
+	return nil
+}
+
+// prefixNames returns the names made of name and leading segments, longest
+// first.
+func prefixNames(name string, segments []string) []string {
+	names := make([]string, 0, len(segments)+1)
+
+	for i := len(segments); i >= 0; i-- {
+		names = append(names, strings.Join(append([]string{name},
+			segments[:i]...), "/"))
+	}
+
+	return names
+}
+
+// prefixRedirect returns the redirect of the longest of prefixNames, counting
+// a hit for it, and the remaining segments. Expired URLs redirect for grace.
+func prefixRedirect(ctx context.Context, tx *sql.Tx, name string,
+	segments []string, grace time.Duration,
+) (redirect, []string, error) {
+	for i, candidate := range prefixNames(name, segments) {
+		rd, err := getRedirect(ctx, tx, candidate, grace)
+		if errors.Is(err, sql.ErrNoRows) {
+			continue
+		} else if err != nil {
+			return redirect{}, nil, err
+		}
+
+		return rd, segments[len(segments)-i:], nil
+	}
+
+	return redirect{}, nil, sql.ErrNoRows
+}
+
+// unlockMaxAge is how long a correct password is remembered.
+const unlockMaxAge = 10 * time.Minute
+
+// unlockCookieName is the name of the cookie unlocking the URL with id.
+func unlockCookieName(id int64) string {
+	return "urlredir-unlock-" + strconv.FormatInt(id, 10)
+}
+
+// unlockSignature signs unlocking rd until expires. The password hash is
+// signed too, so that changing the password locks the URL again.
+func unlockSignature(secret []byte, rd redirect, expires int64) string {
+	mac := hmac.New(sha256.New, secret)
+	fmt.Fprintf(mac, "%d\x00%d\x00%s", rd.ID, expires, rd.PasswordHash)
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// unlockCookie returns a cookie unlocking rd for unlockMaxAge.
+func unlockCookie(secret []byte, r *http.Request, rd redirect) *http.Cookie {
+	expires := now().Add(unlockMaxAge).Unix()
+
+	return &http.Cookie{ //nolint:exhaustruct
+		Name: unlockCookieName(rd.ID),
+		Value: strconv.FormatInt(expires, 10) + "." +
+			unlockSignature(secret, rd, expires),
+		Path:     "/",
+		MaxAge:   int(unlockMaxAge / time.Second),
+		Secure:   r.TLS != nil,
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+}
+
+// unlocked tells whether r carries a valid cookie unlocking rd.
+func unlocked(secret []byte, r *http.Request, rd redirect) bool {
+	cookie, err := r.Cookie(unlockCookieName(rd.ID))
+	if err != nil {
+		return false
+	}
+
+	exp, sig, ok := strings.Cut(cookie.Value, ".")
+	if !ok {
+		return false
+	}
+
+	expires, err := strconv.ParseInt(exp, 10, 64)
+	if err != nil || now().Unix() >= expires {
+		return false
+	}
+
+	return hmac.Equal([]byte(sig), []byte(unlockSignature(secret, rd,
+		expires)))
+}
+
+// unlock asks for the password of rd, or checks a posted one and sends the
+// client back to the URL with an unlocking cookie. No hit is counted.
+func unlock(w http.ResponseWriter, r *http.Request, tx *sql.Tx,
+	secret []byte, rd redirect, tmpl *template.Template,
+) error {
+	if err := tx.Rollback(); err != nil {
+		return fmt.Errorf("%w: %w", ErrFailedRollback, err)
+	}
+
+	if r.Method == http.MethodPost {
+		if err := parseForm(r); err != nil {
+			return err
+		}
+
+		if bcrypt.CompareHashAndPassword([]byte(rd.PasswordHash),
+			[]byte(r.PostFormValue("password"))) == nil {
+			http.SetCookie(w, unlockCookie(secret, r, rd))
+			http.Redirect(w, r, r.URL.String(), http.StatusSeeOther)
+
+			return nil
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusUnauthorized)
+
+	err := tmpl.Execute(w, map[string]interface{}{
+		"failed": r.Method == http.MethodPost,
+	})
+	if err != nil {
+		return fmt.Errorf("failed executing template: %w", err)
+	}
+
+	return nil
+}
+
+// forwardsBody tells whether redirecting r with code makes the client send
+// its method and body on to the target, which a page redirecting in
+// JavaScript can't do.
+func forwardsBody(r *http.Request, code int) bool {
+	return (code == http.StatusTemporaryRedirect ||
+		code == http.StatusPermanentRedirect) &&
+		r.Method != http.MethodGet && r.Method != http.MethodHead
+}
+
+// redirHandler redirects if URL is found in database. Browsers never send the
+// fragment to the server, so with c.JSRedirect a small page redirecting in
+// JavaScript is served instead, forwarding the fragment of the client, unless
+// the client is to forward its body, see forwardsBody. With
+// c.PreviewBody the redirect carries OpenGraph tags for link unfurlers. Unknown
+// names are redirected to c.NotFoundRedirect if set. Any path after the name
+// is appended to the target.
+func redirHandler(c *config) errorHandler {
+	jsTmpl := template.Must(template.New("jsRedirect").Parse(jsRedirectPage))
+	previewTmpl := template.Must(template.New("preview").Parse(previewPage))
+	passwordTmpl := template.Must(template.New("password").Parse(
+		passwordPage))
+
+	// without a configured secret, unlocking lasts until restart
+	secret := secretOrRandom(c.CookieSecret)
+
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+
+		tx := must(getTx(ctx))
+		name := r.PathValue("name")
+		agent := r.UserAgent()
+		referer := filterReferrer(c.ReferrerPolicy, r.Referer(), r.Host)
+
+		slog.Debug("REDIR", slog.String("name", name))
+
+		var referrer *string
+
+		if referer != "" {
+			referrer = &referer
+		}
+
+		residual, err := splitResidual(r.PathValue("rest"))
+		if err != nil {
+			return &HTTPError{ //nolint:exhaustruct
+				Code: http.StatusBadRequest,
+				Err:  err,
+			}
+		}
+
+		rd, rest, err := prefixRedirect(ctx, tx, name, residual,
+			time.Duration(c.ExpiryGraceSeconds)*time.Second)
+		if errors.Is(err, sql.ErrNoRows) && c.GoneWhenExhausted {
+			exhausted, err := exhaustedURL(ctx, tx,
+				prefixNames(name, residual))
+			if err != nil {
+				return err
+			}
+
+			if exhausted {
+				//nolint:exhaustruct
+				return &HTTPError{Code: http.StatusGone}
+			}
+		}
+
+		if errors.Is(err, sql.ErrNoRows) {
+			// old names of regenerated links, see regenerateHandler
+			current, aerr := aliasedName(ctx, tx, name, now())
+			if aerr == nil {
+				u := *r.URL
+				u.Path = "/" + current + strings.TrimPrefix(u.Path, "/"+name)
+				u.RawPath = ""
+
+				code := http.StatusFound
+				if r.Method != http.MethodGet && r.Method != http.MethodHead {
+					code = http.StatusTemporaryRedirect
+				}
+
+				http.Redirect(w, r, u.String(), code)
+
+				return nil
+			} else if !errors.Is(aerr, sql.ErrNoRows) {
+				return aerr
+			}
+		}
+
+		if errors.Is(err, sql.ErrNoRows) && c.NotFoundRedirect != "" {
+			http.Redirect(w, r, c.NotFoundRedirect, http.StatusFound)
+
+			return nil
+		} else if errors.Is(err, sql.ErrNoRows) {
+			//nolint:exhaustruct
+			return &HTTPError{Code: http.StatusNotFound}
+		} else if err != nil {
+			return err
+		}
+
+		if rd.Expired {
+			slog.WarnContext(ctx, "redirecting expired link in grace period",
+				slog.String("name", name))
+		}
+
+		// links created before their target got blocked
+		blocked, err := blockedTarget(ctx, tx, rd.URL)
+		if err != nil {
+			return err
+		}
+
+		if blocked {
+			//nolint:exhaustruct
+			return &HTTPError{Code: http.StatusGone}
+		}
+
+		// other POSTs are redirected like GETs, e.g. forms to 307/308 links
+		if rd.PasswordHash != "" && !unlocked(secret, r, rd) {
+			return unlock(w, r, tx, secret, rd, passwordTmpl)
+		}
+
+		u := rd.URL
+
+		if len(rest) > 0 {
+			u, err = url.JoinPath(u, rest...)
+			if err != nil {
+				return fmt.Errorf("%w: %w", ErrInvalidURL, err)
+			}
+		}
+
+		u, err = withFragment(u, rd.Fragment)
+		if err != nil {
+			return err
+		}
+
+		if c.PassQuery {
+			u, err = withQuery(u, r.URL.Query())
+			if err != nil {
+				return err
+			}
+		}
+
+		if c.InjectCredentials {
+			// exposed to the client in the Location header
+			u, err = withCredentials(u, rd.Userinfo)
+			if err != nil {
+				return err
+			}
+		}
+
+		for k, v := range rd.Headers {
+			w.Header().Set(k, v)
+		}
+
+		code := cmp.Or(rd.Code, c.RedirectCode, defaultRedirectCode)
+
+		if c.JSRedirect && !forwardsBody(r, code) {
+			w.Header().Set("Content-Type", "text/html")
+
+			err = jsTmpl.Execute(w, map[string]interface{}{"url": u})
+			if err != nil {
+				return fmt.Errorf("failed executing template: %w",
+					err)
+			}
+		} else {
+			// only permanent redirects are worth caching
+			if code == http.StatusMovedPermanently {
+				setCacheHeaders(w.Header())
+			}
+
+			w.Header().Set("Content-Type", "text/html")
+			http.Redirect(w, r, u, code)
+
+			if c.PreviewBody {
+				err = previewTmpl.Execute(w, map[string]interface{}{
+					"name": name,
+					"url":  u,
+				})
+				if err != nil {
+					return fmt.Errorf("failed executing template: %w",
+						err)
+				}
+			}
+		}
+
+		ip, err := parseIP(r.RemoteAddr)
+		if err != nil {
+			return err
+		}
+
+		if c.HitWriteMode == hitWriteBestEffort {
+			if err = withSavepoint(ctx, tx, func() error {
+				return addHit(ctx, tx, rd.ID, ip, agent, referrer)
+			}); err != nil {
+				slog.ErrorContext(ctx, "failed recording hit",
+					slog.String("name", name), slog.Any("err", err))
+			}
+		} else if err = addHit(ctx, tx, rd.ID, ip, agent,
+			referrer); err != nil {
+			return err
+		}
+
+		if c.HitAlertWebhook != "" {
+			alert, err := takeHitAlert(ctx, tx, rd.ID, c.HitAlertPercent)
+			if err == nil {
+				// the redirect doesn't wait for the webhook
+				ctx := context.WithoutCancel(ctx)
+
+				go func() {
+					if err := sendHitAlert(ctx, c.HitAlertWebhook,
+						alert); err != nil {
+						slog.ErrorContext(ctx, "failed sending hit alert",
+							slog.String("name", alert.Name),
+							slog.Any("err", err))
+					}
+				}()
+			} else if !errors.Is(err, sql.ErrNoRows) {
+				return err
+			}
+		}
+
+		slog.InfoContext(ctx, "redirect", slog.String("agent", agent),
+			slog.String("referer", referer), slog.String("name", name),
+			slog.String("url", redactURL(u)),
+			slog.String("remote", r.RemoteAddr))
+
+		return nil
+	}
+}
+
+// hitAlertTimeout bounds a hit alert webhook call.
+const hitAlertTimeout = 10 * time.Second
+
+// sendHitAlert posts the alert as JSON to the webhook. Errors leave out the
+// webhook URL, which may have a token in it.
+func sendHitAlert(ctx context.Context, webhook string, a hitAlert) error {
+	ctx, cancel := context.WithTimeout(ctx, hitAlertTimeout)
+	defer cancel()
+
+	body, err := json.Marshal(a)
+	if err != nil {
+		return fmt.Errorf("failed encoding JSON: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, webhook,
+		bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("%w: invalid webhook", ErrWebhookFailed)
+	}
+
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		var uerr *url.Error
+		if errors.As(err, &uerr) {
+			err = uerr.Err
+		}
+
+		return fmt.Errorf("%w: %w", ErrWebhookFailed, err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode >= http.StatusMultipleChoices {
+		return fmt.Errorf("%w: %s", ErrWebhookFailed, resp.Status)
+	}
+
+	return nil
+}
+
+// updateHandler points the named URL to the url in the form, keeping its hits.
+func updateHandler(c *config) errorHandler {
+	return func(_ http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+		tx := must(getTx(ctx))
+		name := r.PathValue("name")
+		user := must(getUser(ctx))
+
+		if _, err := managedURLID(ctx, tx, name); err != nil {
+			return err
+		}
+
+		if err := parseForm(r); err != nil {
+			return err
+		}
+
+		u := r.FormValue("url")
+		if u == "" {
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Err:     ErrMissingURL,
+				Message: string(ErrMissingURL),
+			}
+		}
+
+		if err := validateURL(u, c); err != nil {
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Err:     err,
+				Message: err.Error(),
+			}
+		}
+
+		err := updateURL(ctx, tx, name, u, user)
+		if errors.Is(err, ErrTargetBlocked) {
+			return &HTTPError{
+				Code:    http.StatusForbidden,
+				Err:     err,
+				Message: string(ErrTargetBlocked),
+			}
+		} else if errors.Is(err, sql.ErrNoRows) {
+			//nolint:exhaustruct
+			return &HTTPError{Code: http.StatusForbidden, Err: err}
+		} else if err != nil {
+			return err
+		}
+
+		if err := audit(r, tx, auditUpdate, name); err != nil {
+			return err
+		}
+
+		slog.InfoContext(ctx, "UPDATE", slog.String("remote", r.RemoteAddr),
+			slog.String("name", name), slog.String("url", redactURL(u)))
+
+		return nil
+	}
+}
+
+// ownedURLID returns the ID of the named URL if it is owned by the user in the
+// context, otherwise an HTTPError.
+func ownedURLID(ctx context.Context, tx *sql.Tx, name string) (int64, error) {
+	return authorizedURLID(ctx, tx, name, false)
+}
+
+// managedURLID returns the ID of the named URL if the user in the context
+// owns it or is on its access control list, otherwise an HTTPError.
+func managedURLID(ctx context.Context, tx *sql.Tx, name string) (int64,
+	error,
+) {
+	return authorizedURLID(ctx, tx, name, true)
+}
+
+// authorizedURLID implements ownedURLID and managedURLID.
+func authorizedURLID(ctx context.Context, tx *sql.Tx, name string,
+	acl bool,
+) (int64, error) {
+	user := must(getUser(ctx))
+
+	if user == "" {
+		return 0, &HTTPError{ //nolint:exhaustruct
+			Code:    http.StatusBadRequest,
+			Message: "Missing user",
+		}
+	}
+
+	id, urluser, err := getIDnUser(ctx, tx, name)
+	if errors.Is(err, sql.ErrNoRows) {
+		return 0, &HTTPError{ //nolint:exhaustruct
+			Code: http.StatusNotFound,
+			Err:  err,
+		}
+	} else if err != nil {
+		return 0, err
+	}
+
+	if user == urluser {
+		return id, nil
+	}
+
+	if acl {
+		member, err := inACL(ctx, tx, id, user)
+		if err != nil {
+			return 0, err
+		}
+
+		if member {
+			return id, nil
+		}
+	}
+
+	//nolint:exhaustruct
+	return 0, &HTTPError{Code: http.StatusForbidden}
+}
+
+// deleteHandler removes a specific URL if authorized. With c.IdempotentDelete
+// a missing URL is reported as deleted already.
+func deleteHandler(c *config) errorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+		tx := must(getTx(ctx))
+		name := r.PathValue("name")
+
+		if _, err := managedURLID(ctx, tx, name); err != nil {
+			var herr *HTTPError
+			if c.IdempotentDelete && errors.As(err, &herr) &&
+				herr.Code == http.StatusNotFound {
+				w.WriteHeader(http.StatusNoContent)
+
+				return nil
+			}
+
+			return err
+		}
+
+		err := removeURL(ctx, tx, name)
+		if err != nil {
+			return err
+		}
+
+		if err := audit(r, tx, auditDelete, name); err != nil {
+			return err
+		}
+
+		slog.InfoContext(ctx, "DELETE", slog.String("remote", r.RemoteAddr),
+			slog.String("name", name))
+
+		return nil
+	}
+}
+
+// Results of deleting a link in deleteBatchHandler.
+const (
+	batchDeleted   = "deleted"
+	batchNotFound  = "not-found"
+	batchForbidden = "forbidden"
+	batchSkipped   = "skipped"
+)
+
+// batchResult is the result of deleting the named link in a batch.
+type batchResult struct {
+	Name   string `json:"name"`
+	Result string `json:"result"`
+}
+
+// deleteBatchHandler deletes the links named in a JSON array in one
+// transaction and responds with the result per name. If any of them is
+// forbidden nothing is deleted, unless partial=true.
+func deleteBatchHandler(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	tx := must(getTx(ctx))
+
+	var partial bool
+
+	if s := r.URL.Query().Get("partial"); s != "" {
+		var err error
+
+		partial, err = strconv.ParseBool(s)
+		if err != nil {
+			return &HTTPError{ //nolint:exhaustruct
+				Code: http.StatusBadRequest,
+				Err:  err,
+			}
+		}
+	}
+
+	if err := requireJSON(r); err != nil {
+		return err
+	}
+
+	var names []string
+
+	err := json.NewDecoder(http.MaxBytesReader(w, r.Body,
+		maxAPIBody)).Decode(&names)
+
+	var maxErr *http.MaxBytesError
+	if errors.As(err, &maxErr) {
+		return &HTTPError{
+			Code:    http.StatusRequestEntityTooLarge,
+			Err:     err,
+			Message: string(ErrBodyTooLarge),
+		}
+	} else if err != nil {
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Err:     err,
+			Message: string(ErrMalformedBody),
+		}
+	}
+
+	results := make([]batchResult, len(names))
+	forbidden := false
+
+	for i, name := range names {
+		results[i] = batchResult{Name: name, Result: batchDeleted}
+
+		_, err := managedURLID(ctx, tx, name)
+
+		var herr *HTTPError
+
+		switch {
+		case err == nil:
+		case errors.As(err, &herr) && herr.Code == http.StatusNotFound:
+			results[i].Result = batchNotFound
+		case errors.As(err, &herr) && herr.Code == http.StatusForbidden:
+			results[i].Result = batchForbidden
+			forbidden = true
+		default:
+			return err
+		}
+	}
+
+	abort := forbidden && !partial
+
+	for i, res := range results {
+		if res.Result != batchDeleted {
+			continue
+		}
+
+		if abort {
+			results[i].Result = batchSkipped
+
+			continue
+		}
+
+		if err := removeURL(ctx, tx, res.Name); err != nil {
+			return err
+		}
+
+		if err := audit(r, tx, auditDelete, res.Name); err != nil {
+			return err
+		}
+
+		slog.InfoContext(ctx, "DELETE", slog.String("remote", r.RemoteAddr),
+			slog.String("name", res.Name))
+	}
+
+	status := http.StatusOK
+	if abort {
+		status = http.StatusForbidden
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+
+	if err := json.NewEncoder(w).Encode(results); err != nil {
+		return fmt.Errorf("failed encoding JSON: %w", err)
+	}
+
+	return nil
+}
+
+// audit records action on the named URL by the user in context in the audit
+// log, in the transaction of the action.
+func audit(r *http.Request, tx *sql.Tx, action, name string) error {
+	ctx := r.Context()
+	ip, _ := parseIP(r.RemoteAddr) // nil if unknown
+
+	return addAuditEntry(ctx, tx, must(getUser(ctx)), action, name, ip)
+}
+
+// aclHandler adds (PUT) or removes (DELETE) a user to the access control list
+// of a specific URL. Only the owner may change the list.
+func aclHandler(_ http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	tx := must(getTx(ctx))
+	name := r.PathValue("name")
+	user := r.PathValue("user")
+
+	id, err := ownedURLID(ctx, tx, name)
+	if err != nil {
+		return err
+	}
+
+	if r.Method == http.MethodDelete {
+		err = removeACL(ctx, tx, id, user)
+	} else {
+		err = addACL(ctx, tx, id, user)
+	}
+
+	if err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "ACL", slog.String("method", r.Method),
+		slog.String("name", name), slog.String("user", user))
+
+	return nil
+}
+
+// hitsCSVHandler streams the hit log of a specific URL as CSV if authorized.
+func hitsCSVHandler(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	tx := must(getTx(ctx))
+	name := r.PathValue("name")
+
+	id, err := ownedURLID(ctx, tx, name)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition",
+		fmt.Sprintf("attachment; filename=%q", name+"-hits.csv"))
+
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write([]string{
+		"created", "remotehost", "referrer", "agent",
+	}); err != nil {
+		return fmt.Errorf("failed writing CSV: %w", err)
+	}
+
+	for h, err := range hitsForURL(ctx, tx, id) {
+		if err != nil {
+			return err
+		}
+
+		if err := cw.Write([]string{
+			h.Created.UTC().Format(time.RFC3339), h.RemoteHost,
+			h.Referrer, h.Agent,
+		}); err != nil {
+			return fmt.Errorf("failed writing CSV: %w", err)
+		}
+	}
+
+	cw.Flush()
+
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("failed writing CSV: %w", err)
+	}
+
+	return nil
+}
+
+// exportHandler streams the links of the user as a JSON array or, with
+// format=csv, as CSV.
+func exportHandler(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	tx := must(getTx(ctx))
+	user := must(getUser(ctx))
+
+	switch format := r.URL.Query().Get("format"); format {
+	case "", "json":
+		return exportJSON(w, exportURLs(ctx, tx, user))
+	case "csv":
+		return exportCSV(w, exportURLs(ctx, tx, user))
+	default:
+		err := fmt.Errorf("%w: %s", ErrInvalidFormat, format)
+
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Err:     err,
+			Message: err.Error(),
+		}
+	}
+}
+
+// exportJSON writes urls to w as a JSON array, one element at a time.
+func exportJSON(w http.ResponseWriter, urls iter.Seq2[exportURL, error]) error {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="urlredir.json"`)
+
+	if _, err := io.WriteString(w, "["); err != nil {
+		return fmt.Errorf("failed writing JSON: %w", err)
+	}
+
+	first := true
+
+	for u, err := range urls {
+		if err != nil {
+			return err
+		}
+
+		b, err := json.Marshal(u)
+		if err != nil {
+			return fmt.Errorf("failed encoding JSON: %w", err)
+		}
+
+		if !first {
+			b = append([]byte{','}, b...)
+		}
+
+		if _, err := w.Write(b); err != nil {
+			return fmt.Errorf("failed writing JSON: %w", err)
+		}
+
+		first = false
+	}
+
+	if _, err := io.WriteString(w, "]\n"); err != nil {
+		return fmt.Errorf("failed writing JSON: %w", err)
+	}
+
+	return nil
+}
+
+// exportCSV writes urls to w as CSV with a header row.
+func exportCSV(w http.ResponseWriter, urls iter.Seq2[exportURL, error]) error {
+	w.Header().Set("Content-Type", "text/csv")
+	w.Header().Set("Content-Disposition",
+		`attachment; filename="urlredir.csv"`)
+
+	cw := csv.NewWriter(w)
+
+	if err := cw.Write([]string{"name", "url", "hits", "created"}); err != nil {
+		return fmt.Errorf("failed writing CSV: %w", err)
+	}
+
+	for u, err := range urls {
+		if err != nil {
+			return err
+		}
+
+		if err := cw.Write([]string{
+			u.Name, u.URL, strconv.FormatInt(u.Hits, 10),
+			u.Created.UTC().Format(time.RFC3339),
+		}); err != nil {
+			return fmt.Errorf("failed writing CSV: %w", err)
+		}
+	}
+
+	cw.Flush()
+
+	if err := cw.Error(); err != nil {
+		return fmt.Errorf("failed writing CSV: %w", err)
+	}
+
+	return nil
+}
+
+// timedQuery runs query with a deadline of timeout, 0 for none, returning
+// ErrQueryTimeout if the deadline is exceeded.
+func timedQuery[T any](ctx context.Context, timeout time.Duration, //nolint:ireturn
+	query func(context.Context) (T, error),
+) (T, error) {
+	if timeout <= 0 {
+		return query(ctx)
+	}
+
+	qctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	v, err := query(qctx)
+	if err != nil && errors.Is(qctx.Err(), context.DeadlineExceeded) {
+		var zero T
+
+		return zero, fmt.Errorf("%w: %w", ErrQueryTimeout, err)
+	}
+
+	return v, err
+}
+
+// listTimeoutError rolls back the transaction, as it is unusable after a
+// cancelled query, and returns a friendly 503.
+func listTimeoutError(tx *sql.Tx, err error) error {
+	if rerr := tx.Rollback(); rerr != nil {
+		slog.Debug("rollback after timeout", slog.Any("err", rerr))
+	}
+
+	return &HTTPError{
+		Code:    http.StatusServiceUnavailable,
+		Err:     err,
+		Message: "Listing links took too long, please try again later",
+	}
+}
+
+// Page sizes of the admin listing.
+const (
+	defaultAdminLimit = 50
+	maxAdminLimit     = 1000
+)
+
+// adminPageLink returns the query of the admin listing page at offset, keeping
+// the other parameters of r.
+func adminPageLink(r *http.Request, offset int) string {
+	q := r.URL.Query()
+	q.Del("created")
+	q.Set("offset", strconv.Itoa(offset))
+
+	return "?" + q.Encode()
+}
+
+// parseSort parses the sort and dir query parameters of the admin listing.
+// Names are sorted ascending and the others descending by default, and
+// creation is the default key.
+func parseSort(r *http.Request) (string, bool, error) {
+	q := r.URL.Query()
+
+	sort := cmp.Or(q.Get("sort"), "created")
+	if _, ok := urlSortColumns[sort]; !ok {
+		return "", false, fmt.Errorf("%w: %s", ErrInvalidSort, sort)
+	}
+
+	switch dir := q.Get("dir"); dir {
+	case "":
+		return sort, sort != "name", nil
+	case "asc":
+		return sort, false, nil
+	case "desc":
+		return sort, true, nil
+	default:
+		return "", false, fmt.Errorf("%w: dir %s", ErrInvalidSort, dir)
+	}
+}
+
+// sortLink is a link ordering the admin listing by Key.
+type sortLink struct {
+	Key  string
+	Href string
+	// Current tells whether the listing is ordered by Key, Desc in which
+	// direction
+	Current bool
+	Desc    bool
+}
+
+// adminSortLinks returns links ordering the admin listing by each key, from
+// the first page. The link of the current key reverses the order.
+func adminSortLinks(r *http.Request, sort string, desc bool) []sortLink {
+	links := make([]sortLink, 0, len(urlSortColumns))
+
+	for _, key := range slices.Sorted(maps.Keys(urlSortColumns)) {
+		q := r.URL.Query()
+		q.Del("created")
+		q.Del("offset")
+		q.Set("sort", key)
+		q.Del("dir")
+
+		if key == sort {
+			dir := "desc"
+			if desc {
+				dir = "asc"
+			}
+
+			q.Set("dir", dir)
+		}
+
+		links = append(links, sortLink{
+			Key:     key,
+			Href:    "?" + q.Encode(),
+			Current: key == sort,
+			Desc:    desc,
+		})
+	}
+
+	return links
+}
+
+// cspNonceSize is the number of random bytes in a CSP nonce.
+const cspNonceSize = 16
+
+// newCSPNonce returns a new nonce for the scripts of a page.
+func newCSPNonce() string {
+	b := make([]byte, cspNonceSize)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+
+	return base64.StdEncoding.EncodeToString(b)
+}
+
+// adminCSP returns the Content-Security-Policy of the admin page, allowing
+// only scripts carrying nonce.
+func adminCSP(nonce string) string {
+	return "default-src 'self'; script-src 'nonce-" + nonce +
+		"'; style-src 'self' 'unsafe-inline'; object-src 'none'; " +
+		"base-uri 'none'"
+}
+
+// adminGetHandler serves admin page using the given template, or the URLs of
+// the user as JSON if the client asks for it.
+func adminGetHandler(c *config, themes adminThemes) errorHandler {
+	timeout := time.Duration(c.ListTimeoutSeconds) * time.Second
+
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+		tx := must(getTx(ctx))
+		user := must(getUser(ctx))
+
+		// JSON clients get all links unless they ask for a page
+		def := defaultAdminLimit
+		if wantsJSON(r) {
+			def = 0
+		}
+
+		limit, offset, err := parsePage(r, def, maxAdminLimit)
+		if err != nil {
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Err:     err,
+				Message: err.Error(),
+			}
+		}
+
+		sort, desc, err := parseSort(r)
+		if err != nil {
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Err:     err,
+				Message: err.Error(),
+			}
+		}
+
+		query := urlQuery{
+			Search: r.URL.Query().Get("q"),
+			Limit:  limit,
+			Offset: offset,
+			Sort:   sort,
+			Desc:   desc,
+		}
+
+		var total int
+
+		urls, err := timedQuery(ctx, timeout, func(ctx context.Context) (
+			[]URL, error,
+		) {
+			urls, n, err := searchURLsForUser(ctx, tx, user, query)
+			total = n
+
+			return urls, err
+		})
+		if errors.Is(err, ErrQueryTimeout) {
+			return listTimeoutError(tx, err)
+		} else if err != nil {
+			return err
+		}
+
+		if wantsJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			w.Header().Set("X-Total-Count", strconv.Itoa(total))
+
+			if err := json.NewEncoder(w).Encode(urls); err != nil {
+				return fmt.Errorf("failed encoding JSON: %w", err)
+			}
+
+			return nil
+		}
+
+		nonce := newCSPNonce()
+		w.Header().Set("Content-Security-Policy", adminCSP(nonce))
+
+		params := map[string]interface{}{
+			"path":        r.URL.Path,
+			"user":        user,
+			"urls":        urls,
+			"credentials": c.InjectCredentials,
+			"created":     r.URL.Query().Get("created"),
+			"csrf":        getCSRFToken(ctx),
+			"admin":       c.isAdmin(user),
+			"nonce":       nonce,
+			"search":      query.Search,
+			"total":       total,
+			"first":       offset + 1,
+			"last":        offset + len(urls),
+			"sorts":       adminSortLinks(r, sort, desc),
+		}
+
+		if offset > 0 {
+			params["prev"] = adminPageLink(r, max(offset-limit, 0))
+		}
+
+		if offset+len(urls) < total {
+			params["next"] = adminPageLink(r, offset+limit)
+		}
+
+		err = themes.forHost(r.Host).Execute(w, params)
+		if err != nil {
+			return fmt.Errorf("failed executing template: %w", err)
+		}
+
+		return nil
+	}
+}
+
+// parseForm parses the form of r, returning an HTTPError if it is malformed.
+// Without it FormValue would report malformed fields as missing.
+func parseForm(r *http.Request) error {
+	if err := r.ParseForm(); err != nil {
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Err:     fmt.Errorf("%w: %w", ErrMalformedForm, err),
+			Message: string(ErrMalformedForm),
+		}
+	}
+
+	return nil
+}
+
+// requireJSON checks that the body of r is declared as JSON, which forms on
+// other sites can't send.
+func requireJSON(r *http.Request) error {
+	if mt, _, _ := mime.ParseMediaType(r.Header.Get(
+		"Content-Type")); mt != "application/json" {
+		return &HTTPError{ //nolint:exhaustruct
+			Code:    http.StatusUnsupportedMediaType,
+			Message: "Content-Type must be application/json",
+		}
+	}
+
+	return nil
+}
+
+// validateAdminForm perform form parameter validation for admin page. The name
+// is empty if one should be generated. The owner is the user in the context,
+// only admins may add links for others with the user field.
+func validateAdminForm(r *http.Request, c *config) (string, string, string,
+	error,
+) {
+	name := r.FormValue("name")
+	u := r.FormValue("url")
+	user := must(getUser(r.Context()))
+
+	if owner := r.FormValue("user"); owner != "" &&
+		!c.ForceOwnerFromContext && c.isAdmin(user) {
+		user = owner
+	}
+
+	if err := validateLink(name, u, user, c); err != nil {
+		return "", "", "", err
+	}
+
+	return name, u, user, nil
+}
+
+// validateLink checks a new link, see validateAdminForm.
+func validateLink(name, u, user string, c *config) error {
+	if u == "" {
+		return ErrMissingURL
+	}
+
+	if name != "" {
+		if err := validateName(name); err != nil {
+			return err
+		}
+	}
+
+	if c.isReserved(name) {
+		return ErrReservedName
+	}
+
+	if err := validateURL(u, c); err != nil {
+		return err
+	}
+
+	if user == "" {
+		return ErrMissingUser
+	}
+
+	return nil
+}
+
+// validateURL checks that links may point to u.
+func validateURL(u string, c *config) error {
+	if c.MaxURLLength > 0 && len(u) > c.MaxURLLength {
+		return ErrURLTooLong
+	}
+
+	parsed, err := url.Parse(u)
+	if err != nil {
+		return ErrInvalidURL
+	}
+
+	// e.g. javascript: and data: URLs would run in the admin page
+	if !c.schemeAllowed(parsed.Scheme) || parsed.Host == "" {
+		return ErrInvalidURL
+	}
+
+	if !c.targetHostAllowed(parsed.Hostname()) {
+		return fmt.Errorf("%w: %s", ErrTargetHostDenied, parsed.Hostname())
+	}
+
+	return nil
+}
+
+// hostMatches tells whether host matches pattern, where "*.example.com"
+// matches any subdomain of example.com but not example.com itself.
+func hostMatches(pattern, host string) bool {
+	if suffix, ok := strings.CutPrefix(pattern, "*."); ok {
+		return len(host) > len(suffix)+1 &&
+			strings.EqualFold(host[len(host)-len(suffix)-1:], "."+suffix)
+	}
+
+	return strings.EqualFold(pattern, host)
+}
+
+// parseURLOptions parses the optional URL settings of the admin form.
+func parseURLOptions(r *http.Request, c *config) (urlOptions, error) {
+	opts := urlOptions{
+		Fragment: strings.TrimPrefix(r.FormValue("fragment"), "#"),
+		Userinfo: r.FormValue("credentials"),
+	}
+
+	if opts.Userinfo != "" && !c.InjectCredentials {
+		return urlOptions{}, ErrCredentialsDisabled
+	}
+
+	if code := r.FormValue("code"); code != "" {
+		var err error
+
+		opts.Code, err = strconv.Atoi(code)
+		if err != nil || !isRedirectCode(opts.Code) {
+			return urlOptions{}, fmt.Errorf("%w: %s", ErrInvalidCode, code)
+		}
+	}
+
+	if maxHits := r.FormValue("max_hits"); maxHits != "" {
+		var err error
+
+		opts.MaxHits, err = strconv.ParseInt(maxHits, 10, 64)
+		if err != nil || opts.MaxHits < 1 {
+			return urlOptions{}, fmt.Errorf("%w: %s", ErrInvalidMaxHits,
+				maxHits)
+		}
+	}
+
+	if expires := r.FormValue("expires"); expires != "" {
+		t, err := parseExpiry(expires)
+		if err != nil {
+			return urlOptions{}, err
+		}
+
+		opts.ExpiresAt = &t
+	}
+
+	if password := r.FormValue("password"); password != "" {
+		hash, err := bcrypt.GenerateFromPassword([]byte(password),
+			bcrypt.DefaultCost)
+		if err != nil {
+			return urlOptions{}, fmt.Errorf("%w: %w", ErrInvalidPassword, err)
+		}
+
+		opts.PasswordHash = string(hash)
+	}
+
+	if h := r.FormValue("headers"); h != "" {
+		headers, err := parseHeaders(h)
+		if err != nil {
+			return urlOptions{}, err
+		}
+
+		opts.Headers = headers
+	}
+
+	return opts, nil
+}
+
+// expiryLayouts are the accepted formats of expiry times, without a zone in UTC.
+//
+//nolint:gochecknoglobals
+var expiryLayouts = []string{time.RFC3339, "2006-01-02T15:04", "2006-01-02"}
+
+// parseExpiry parses an expiry time in one of expiryLayouts.
+func parseExpiry(s string) (time.Time, error) {
+	for _, layout := range expiryLayouts {
+		if t, err := time.Parse(layout, s); err == nil {
+			return t.UTC(), nil
+		}
+	}
+
+	return time.Time{}, fmt.Errorf("%w: %s", ErrInvalidExpiry, s)
+}
+
+// isRedirectCode tells whether code is a supported redirect status.
+func isRedirectCode(code int) bool {
+	switch code {
+	case http.StatusMovedPermanently, http.StatusFound,
+		http.StatusTemporaryRedirect, http.StatusPermanentRedirect:
+		return true
+	default:
+		return false
+	}
+}
+
+// allowedHeaders are the response headers that can be set per URL. Anything
+// affecting the redirect itself or security of the service is left out.
+//
+//nolint:gochecknoglobals
+var allowedHeaders = []string{
+	"Content-Language",
+	"Link",
+	"Referrer-Policy",
+	"X-Robots-Tag",
+}
+
+// parseHeaders parses a JSON object of allowed headers.
+func parseHeaders(s string) (map[string]string, error) {
+	var headers map[string]string
+
+	if err := json.Unmarshal([]byte(s), &headers); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrInvalidHeader, err)
+	}
+
+	canonical := make(map[string]string, len(headers))
+
+	for k, v := range headers {
+		k = http.CanonicalHeaderKey(k)
+		if !slices.Contains(allowedHeaders, k) {
+			return nil, fmt.Errorf("%w: %s", ErrInvalidHeader, k)
+		}
+
+		canonical[k] = v
+	}
+
+	return canonical, nil
+}
+
+// checkQuota returns an HTTPError if user may not add more URLs.
+func checkQuota(ctx context.Context, tx *sql.Tx, c *config, user string) error {
+	limit, err := linkQuota(ctx, tx, user, c.MaxLinksPerUser)
+	if err != nil {
+		return err
+	}
+
+	if limit <= 0 {
+		return nil
+	}
+
+	count, err := countURLsForUser(ctx, tx, user)
+	if err != nil {
+		return err
+	}
+
+	if count >= limit {
+		return &HTTPError{
+			Code:    http.StatusForbidden,
+			Err:     ErrQuotaExceeded,
+			Message: string(ErrQuotaExceeded),
+		}
+	}
+
+	return nil
+}
+
+// adminPostHandler inserts URLs to database, under a generated name if none
+// is given, and redirects back to the admin page with the name as created.
+// Clients asking for JSON get the created URL instead.
+func adminPostHandler(c *config) errorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+		tx := must(getTx(ctx))
+		must(getUser(ctx))
+
+		if err := parseForm(r); err != nil {
+			return err
+		}
+
+		name, u, user, err := validateAdminForm(r, c)
+		if err != nil {
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Err:     err,
+				Message: err.Error(),
+			}
+		}
+
+		if err := checkQuota(ctx, tx, c, user); err != nil {
+			return err
+		}
+
+		opts, err := parseURLOptions(r, c)
+		if err != nil {
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Err:     err,
+				Message: err.Error(),
+			}
+		}
+
+		if name != "" && c.ReuseDeletedNames {
+			if err := purgeDeletedName(ctx, tx, name); err != nil {
+				return err
+			}
+		}
+
+		if name == "" {
+			name, err = generateName(c, func(name string) error {
+				return withSavepoint(ctx, tx, func() error {
+					return addURL(ctx, tx, name, u, user, opts)
+				})
+			})
+		} else {
+			err = addURL(ctx, tx, name, u, user, opts)
+		}
+
+		if isUniqueViolation(err) {
+			return &HTTPError{
+				Code:    http.StatusConflict,
+				Err:     err,
+				Message: string(ErrNameTaken),
+			}
+		} else if errors.Is(err, ErrTargetBlocked) {
+			return &HTTPError{
+				Code:    http.StatusForbidden,
+				Err:     err,
+				Message: string(ErrTargetBlocked),
+			}
+		} else if err != nil {
+			return err
+		}
+
+		if err := audit(r, tx, auditCreate, name); err != nil {
+			return err
+		}
+
+		if wantsJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusCreated)
+
+			if err := json.NewEncoder(w).Encode(map[string]string{
+				"name": name,
+				"url":  u,
+				"user": user,
+			}); err != nil {
+				return fmt.Errorf("failed encoding JSON: %w", err)
+			}
+
+			return nil
+		}
+
+		http.Redirect(w, r, "/_admin?"+url.Values{"created": {name}}.Encode(),
+			http.StatusSeeOther)
+
+		return nil
+	}
+}
+
+// jsonErrors makes h return its errors as JSONError. Used for the JSON API.
+func jsonErrors(h errorHandler) errorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		err := h(w, r)
+		if err == nil {
+			return nil
+		}
+
+		herr := &HTTPError{ //nolint:exhaustruct
+			Code: http.StatusInternalServerError,
+			Err:  err,
+		}
+		errors.As(err, &herr)
+
+		return JSONError{herr}
+	}
+}
+
+// apiLink is a link in the JSON API.
+type apiLink struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+}
+
+// apiCreateHandler adds a URL from a JSON apiLink owned by the user in context,
+// under a generated name if none is given, and responds with the created URL.
+func apiCreateHandler(c *config) errorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+		tx := must(getTx(ctx))
+		user := must(getUser(ctx))
+
+		if err := requireJSON(r); err != nil {
+			return err
+		}
+
+		var link apiLink
+
+		err := json.NewDecoder(http.MaxBytesReader(w, r.Body,
+			maxAPIBody)).Decode(&link)
+
+		var maxErr *http.MaxBytesError
+		if errors.As(err, &maxErr) {
+			return &HTTPError{
+				Code:    http.StatusRequestEntityTooLarge,
+				Err:     err,
+				Message: string(ErrBodyTooLarge),
+			}
+		} else if err != nil {
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Err:     err,
+				Message: string(ErrMalformedBody),
+			}
+		}
+
+		if err := validateLink(link.Name, link.URL, user, c); err != nil {
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Err:     err,
+				Message: err.Error(),
+			}
+		}
+
+		if err := checkQuota(ctx, tx, c, user); err != nil {
+			return err
+		}
+
+		add := func(name string) error {
+			return withSavepoint(ctx, tx, func() error {
+				return addURL(ctx, tx, name, link.URL, user,
+					urlOptions{}) //nolint:exhaustruct
+			})
+		}
+
+		if link.Name != "" && c.ReuseDeletedNames {
+			if err := purgeDeletedName(ctx, tx, link.Name); err != nil {
+				return err
+			}
+		}
+
+		if link.Name == "" {
+			link.Name, err = generateName(c, add)
+		} else {
+			err = add(link.Name)
+		}
+
+		if isUniqueViolation(err) {
+			return &HTTPError{
+				Code:    http.StatusConflict,
+				Err:     err,
+				Message: string(ErrNameTaken),
+			}
+		} else if errors.Is(err, ErrTargetBlocked) {
+			return &HTTPError{
+				Code:    http.StatusForbidden,
+				Err:     err,
+				Message: string(ErrTargetBlocked),
+			}
+		} else if err != nil {
+			return err
+		}
+
+		if err := audit(r, tx, auditCreate, link.Name); err != nil {
+			return err
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+
+		if err := json.NewEncoder(w).Encode(link); err != nil {
+			return fmt.Errorf("failed encoding JSON: %w", err)
+		}
+
+		return nil
+	}
+}
+
+// apiGetHandler responds with the metadata of the named URL as JSON, without
+// counting a hit. Unique visitors are counted since the optional since query
+// parameter. Only for its owner, users on its access control list and admins.
+func apiGetHandler(c *config) errorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+		tx := must(getTx(ctx))
+		user := must(getUser(ctx))
+
+		meta, err := getURLMeta(ctx, tx, r.PathValue("name"))
+		if errors.Is(err, sql.ErrNoRows) {
+			//nolint:exhaustruct
+			return &HTTPError{Code: http.StatusNotFound, Err: err}
+		} else if err != nil {
+			return err
+		}
+
+		if user != meta.User && !c.isAdmin(user) {
+			member, err := inACL(ctx, tx, meta.ID, user)
+			if err != nil {
+				return err
+			}
+
+			if user == "" || !member {
+				//nolint:exhaustruct
+				return &HTTPError{Code: http.StatusForbidden}
+			}
+		}
+
+		var since time.Time
+
+		if v := r.URL.Query().Get("since"); v != "" {
+			since, err = time.Parse(time.RFC3339, v)
+			if err != nil {
+				err = fmt.Errorf("%w: %s", ErrInvalidSince, v)
+
+				return &HTTPError{
+					Code:    http.StatusBadRequest,
+					Err:     err,
+					Message: err.Error(),
+				}
+			}
+		}
+
+		meta.Visitors, err = uniqueVisitors(ctx, tx, meta.ID, since)
+		if err != nil {
+			return err
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(meta); err != nil {
+			return fmt.Errorf("failed encoding JSON: %w", err)
+		}
+
+		return nil
+	}
+}
+
+// qrRecoveryLevels are the QR code error correction levels by name.
+//
+//nolint:gochecknoglobals
+var qrRecoveryLevels = map[string]qrcode.RecoveryLevel{
+	"L": qrcode.Low,
+	"M": qrcode.Medium,
+	"Q": qrcode.High,
+	"H": qrcode.Highest,
+}
+
+// qrMaxAge is how long clients may cache QR codes, in seconds.
+const qrMaxAge = 24 * 60 * 60
+
+// absoluteURL returns the fully-qualified short URL of the named link, on
+// BaseURL or else the scheme and host of r. The name is escaped as a single
+// path segment.
+func absoluteURL(c *config, r *http.Request, name string) string {
+	base := c.BaseURL
+	if base == "" {
+		scheme := "http"
+		if r.TLS != nil {
+			scheme = "https"
+		}
+
+		base = scheme + "://" + r.Host
+	}
+
+	return strings.TrimSuffix(base, "/") + "/" + url.PathEscape(name)
+}
+
+// qrHandler responds with the short URL of the named link as a QR code PNG.
+// It is public like the short URL itself, revealing nothing about the link
+// but that it exists, which redirecting does as well.
+func qrHandler(c *config) errorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+		tx := must(getTx(ctx))
+		name := r.PathValue("name")
+
+		if _, err := getURLMeta(ctx, tx, name); errors.Is(err,
+			sql.ErrNoRows) {
+			//nolint:exhaustruct
+			return &HTTPError{Code: http.StatusNotFound, Err: err}
+		} else if err != nil {
+			return err
+		}
+
+		png, err := qrcode.Encode(absoluteURL(c, r, name),
+			qrRecoveryLevels[c.QRRecoveryLevel], c.QRSize)
+		if err != nil {
+			return fmt.Errorf("failed encoding QR code: %w", err)
+		}
+
+		w.Header().Set("Content-Type", "image/png")
+		w.Header().Set("Cache-Control",
+			"public, max-age="+strconv.Itoa(qrMaxAge))
+
+		if _, err := w.Write(png); err != nil {
+			return fmt.Errorf("failed writing QR code: %w", err)
+		}
+
+		return nil
+	}
+}
+
+// Page sizes of hits, referrers and the audit log in the API.
+const (
+	defaultHitsLimit      = 100
+	maxHitsLimit          = 1000
+	defaultReferrersLimit = 10
+	maxReferrersLimit     = 100
+	defaultAuditLimit     = 100
+	maxAuditLimit         = 1000
+)
+
+// parsePage parses the limit and offset query parameters, limit defaulting to
+// def and capped to maxLimit.
+func parsePage(r *http.Request, def, maxLimit int) (int, int, error) {
+	limit, offset := def, 0
+	q := r.URL.Query()
+
+	if l := q.Get("limit"); l != "" {
+		var err error
+
+		limit, err = strconv.Atoi(l)
+		if err != nil || limit < 1 {
+			return 0, 0, fmt.Errorf("%w: limit %s", ErrInvalidPage, l)
+		}
+	}
+
+	if o := q.Get("offset"); o != "" {
+		var err error
+
+		offset, err = strconv.Atoi(o)
+		if err != nil || offset < 0 {
+			return 0, 0, fmt.Errorf("%w: offset %s", ErrInvalidPage, o)
+		}
+	}
+
+	return min(limit, maxLimit), offset, nil
+}
+
+// apiHitsHandler responds with a page of the hits of the named URL as JSON,
+// newest first. Owner only.
+func apiHitsHandler(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	tx := must(getTx(ctx))
+
+	id, err := ownedURLID(ctx, tx, r.PathValue("name"))
+	if err != nil {
+		return err
+	}
+
+	limit, offset, err := parsePage(r, defaultHitsLimit, maxHitsLimit)
+	if err != nil {
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Err:     err,
+			Message: err.Error(),
+		}
+	}
+
+	hits, err := hitsPage(ctx, tx, id, limit, offset)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"hits":   hits,
+		"limit":  limit,
+		"offset": offset,
+	}); err != nil {
+		return fmt.Errorf("failed encoding JSON: %w", err)
+	}
+
+	return nil
+}
+
+// Days of daily hit counts in the API.
+const (
+	defaultStatsDays = 30
+	maxStatsDays     = 366
+)
+
+// apiDailyHandler responds with the daily hit counts of the named URL for the
+// number of days in the days query parameter as JSON. Owner only.
+func apiDailyHandler(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	tx := must(getTx(ctx))
+
+	id, err := ownedURLID(ctx, tx, r.PathValue("name"))
+	if err != nil {
+		return err
+	}
+
+	days := defaultStatsDays
+
+	if d := r.URL.Query().Get("days"); d != "" {
+		days, err = strconv.Atoi(d)
+		if err != nil || days < 1 || days > maxStatsDays {
+			err = fmt.Errorf("%w: %s", ErrInvalidDays, d)
+
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Err:     err,
+				Message: err.Error(),
+			}
+		}
+	}
+
+	counts, err := hitsByDay(ctx, tx, id, now(), days)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(counts); err != nil {
+		return fmt.Errorf("failed encoding JSON: %w", err)
+	}
+
+	return nil
+}
+
+// apiReferrersHandler responds with a page of the most common referrers of
+// the named URL as JSON. Owner only.
+func apiReferrersHandler(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	tx := must(getTx(ctx))
+
+	id, err := ownedURLID(ctx, tx, r.PathValue("name"))
+	if err != nil {
+		return err
+	}
+
+	limit, offset, err := parsePage(r, defaultReferrersLimit,
+		maxReferrersLimit)
+	if err != nil {
+		return &HTTPError{
+			Code:    http.StatusBadRequest,
+			Err:     err,
+			Message: err.Error(),
+		}
+	}
+
+	counts, err := topReferrers(ctx, tx, id, limit, offset)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(map[string]interface{}{
+		"referrers": counts,
+		"limit":     limit,
+		"offset":    offset,
+	}); err != nil {
+		return fmt.Errorf("failed encoding JSON: %w", err)
+	}
+
+	return nil
+}
+
+// apiAgentsHandler responds with the hits of the named URL per browser and
+// operating system as JSON. Owner only.
+func apiAgentsHandler(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	tx := must(getTx(ctx))
+
+	id, err := ownedURLID(ctx, tx, r.PathValue("name"))
+	if err != nil {
+		return err
+	}
+
+	stats, err := statsByAgent(ctx, tx, id)
+	if err != nil {
+		return err
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+
+	if err := json.NewEncoder(w).Encode(stats); err != nil {
+		return fmt.Errorf("failed encoding JSON: %w", err)
+	}
+
+	return nil
+}
+
+// requireAdmin returns an HTTPError unless the user in context is an admin.
+func requireAdmin(ctx context.Context, c *config) error {
+	user := must(getUser(ctx))
+
+	if !c.isAdmin(user) {
+		//nolint:exhaustruct
+		return &HTTPError{Code: http.StatusForbidden}
+	}
+
+	return nil
+}
+
+// tokenHandler mints an API token for the user in context. The token is only
+// shown in the response, just its hash is stored.
+func tokenHandler(w http.ResponseWriter, r *http.Request) error {
+	ctx := r.Context()
+	tx := must(getTx(ctx))
+	user := must(getUser(ctx))
+
+	if user == "" {
+		return &HTTPError{ //nolint:exhaustruct
+			Code: http.StatusBadRequest,
+			Err:  ErrMissingUser,
+		}
+	}
+
+	token := newAPIToken()
+
+	if err := addAPIToken(ctx, tx, hashAPIToken(token), user); err != nil {
+		return err
+	}
+
+	slog.InfoContext(ctx, "TOKEN", slog.String("user", user))
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusCreated)
+
+	if err := json.NewEncoder(w).Encode(map[string]string{
+		"token": token,
+		"user":  user,
+	}); err != nil {
+		return fmt.Errorf("failed encoding JSON: %w", err)
+	}
+
+	return nil
+}
+
+// auditHandler responds with a page of the audit log as JSON, newest first.
+// Admin only.
+func auditHandler(c *config) errorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+		tx := must(getTx(ctx))
+
+		if err := requireAdmin(ctx, c); err != nil {
+			return err
+		}
+
+		limit, offset, err := parsePage(r, defaultAuditLimit, maxAuditLimit)
+		if err != nil {
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Err:     err,
+				Message: err.Error(),
+			}
+		}
+
+		entries, err := auditLog(ctx, tx, limit, offset)
+		if err != nil {
+			return err
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(map[string]interface{}{
+			"entries": entries,
+			"limit":   limit,
+			"offset":  offset,
+		}); err != nil {
+			return fmt.Errorf("failed encoding JSON: %w", err)
+		}
+
+		return nil
+	}
+}
+
+// Sizes of the leaderboard of links.
+const (
+	defaultTopLimit = 20
+	maxTopLimit     = 100
+)
+
+// topHandler renders the most popular links of all users, or responds with
+// them as JSON if asked to. Admin only.
+func topHandler(c *config) errorHandler {
+	tmpl := template.Must(template.New("top").Parse(topPage))
+
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+		tx := must(getTx(ctx))
+
+		if err := requireAdmin(ctx, c); err != nil {
+			return err
+		}
+
+		limit, _, err := parsePage(r, defaultTopLimit, maxTopLimit)
+		if err != nil {
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Err:     err,
+				Message: err.Error(),
+			}
+		}
+
+		top, err := topURLs(ctx, tx, limit)
+		if err != nil {
+			return err
+		}
+
+		if wantsJSON(r) {
+			w.Header().Set("Content-Type", "application/json")
+
+			if err := json.NewEncoder(w).Encode(top); err != nil {
+				return fmt.Errorf("failed encoding JSON: %w", err)
+			}
+
+			return nil
+		}
+
+		if err := tmpl.Execute(w, map[string]interface{}{
+			"top": top,
+		}); err != nil {
+			return fmt.Errorf("failed executing template: %w", err)
+		}
+
+		return nil
+	}
+}
+
+// quotaHandler overrides the maximum number of URLs for a user. Admin only.
+func quotaHandler(c *config) errorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+		tx := must(getTx(ctx))
+
+		if err := requireAdmin(ctx, c); err != nil {
+			return err
+		}
+
+		if err := parseForm(r); err != nil {
+			return err
+		}
+
+		user := r.FormValue("user")
+		if user == "" {
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Err:     ErrMissingUser,
+				Message: string(ErrMissingUser),
+			}
+		}
+
+		maxLinks, err := strconv.Atoi(r.FormValue("max_links"))
+		if err != nil {
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Err:     err,
+				Message: string(ErrInvalidQuota),
+			}
+		}
+
+		if err := setQuota(ctx, tx, user, maxLinks); err != nil {
+			return err
+		}
+
+		slog.InfoContext(ctx, "QUOTA", slog.String("user", user),
+			slog.Int("maxLinks", maxLinks))
+
+		http.Redirect(w, r, "/_admin", http.StatusSeeOther)
+
+		return nil
+	}
+}
+
+// undeleteHandler restores the deleted URL named in the form. Admin only.
+func undeleteHandler(c *config) errorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+		tx := must(getTx(ctx))
+
+		if err := requireAdmin(ctx, c); err != nil {
+			return err
+		}
+
+		if err := parseForm(r); err != nil {
+			return err
+		}
+
+		name := r.FormValue("name")
+
+		err := undeleteURL(ctx, tx, name)
+		if errors.Is(err, sql.ErrNoRows) {
+			//nolint:exhaustruct
+			return &HTTPError{Code: http.StatusNotFound, Err: err}
+		} else if err != nil {
+			return err
+		}
+
+		if err := audit(r, tx, auditUndelete, name); err != nil {
+			return err
+		}
+
+		slog.InfoContext(ctx, "UNDELETE", slog.String("name", name))
+
+		http.Redirect(w, r, "/_admin", http.StatusSeeOther)
+
+		return nil
 	}
+}
 
-	err = removeURL(ctx, tx, name)
-	if err != nil {
-		return err
+// normalizeBlock checks that target is an absolute URL or a domain, and
+// returns it in the form matched by blockedTarget.
+func normalizeBlock(target string) (string, error) {
+	target = strings.TrimSpace(target)
+
+	if strings.Contains(target, "://") {
+		parsed, err := url.Parse(target)
+		if err != nil || parsed.Host == "" {
+			return "", fmt.Errorf("%w: %s", ErrInvalidTarget, target)
+		}
+
+		return target, nil
 	}
 
-	slog.InfoContext(ctx, "DELETE", slog.String("remote", r.RemoteAddr),
-		slog.String("name", name))
+	domain := strings.TrimSuffix(strings.ToLower(target), ".")
+	if domain == "" || strings.ContainsAny(domain, "/:@?# ") {
+		return "", fmt.Errorf("%w: %s", ErrInvalidTarget, target)
+	}
 
-	return nil
+	return domain, nil
 }
 
-// adminGetHandler serves admin page.
-func adminGetHandler(w http.ResponseWriter, r *http.Request) error {
-	ctx := r.Context()
-	tx := must(getTx(ctx))
-	user := must(getUser(ctx))
+// blockHandler blocks links to the URL or domain in the target form field.
+// Admin only.
+func blockHandler(c *config) errorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+		tx := must(getTx(ctx))
 
-	urls, err := urlsForUser(ctx, tx, user)
-	if err != nil {
-		return err
+		if err := requireAdmin(ctx, c); err != nil {
+			return err
+		}
+
+		if err := parseForm(r); err != nil {
+			return err
+		}
+
+		target, err := normalizeBlock(r.FormValue("target"))
+		if err != nil {
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Err:     err,
+				Message: err.Error(),
+			}
+		}
+
+		if err := blockTarget(ctx, tx, target,
+			must(getUser(ctx))); err != nil {
+			return err
+		}
+
+		slog.InfoContext(ctx, "BLOCK", slog.String("target", target))
+
+		http.Redirect(w, r, "/_admin", http.StatusSeeOther)
+
+		return nil
 	}
+}
 
-	t, err := template.New("adminPage").Parse(adminPage)
-	if err != nil {
-		return fmt.Errorf("failed parsing template: %w", err)
+// unblockHandler removes the block of the target query parameter. Admin only.
+func unblockHandler(c *config) errorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+		tx := must(getTx(ctx))
+
+		if err := requireAdmin(ctx, c); err != nil {
+			return err
+		}
+
+		target, err := normalizeBlock(r.URL.Query().Get("target"))
+		if err != nil {
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Err:     err,
+				Message: err.Error(),
+			}
+		}
+
+		err = unblockTarget(ctx, tx, target)
+		if errors.Is(err, sql.ErrNoRows) {
+			//nolint:exhaustruct
+			return &HTTPError{Code: http.StatusNotFound, Err: err}
+		} else if err != nil {
+			return err
+		}
+
+		slog.InfoContext(ctx, "UNBLOCK", slog.String("target", target))
+
+		w.WriteHeader(http.StatusNoContent)
+
+		return nil
+	}
+}
+
+// recountBatchSize is the number of URLs recounted per transaction.
+const recountBatchSize = 1000
+
+// recountHandler rebuilds hit counts from the hits table. Admin only. Each
+// batch is committed separately to keep redirects flowing meanwhile.
+func recountHandler(c *config, db beginner) errorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+
+		if err := requireAdmin(ctx, c); err != nil {
+			return err
+		}
+
+		var after, total int64
+
+		for {
+			tx, err := db.BeginTx(ctx, nil)
+			if err != nil {
+				return fmt.Errorf("failed beginning tx: %w", err)
+			}
+
+			last, updated, err := recountHits(ctx, tx, after,
+				recountBatchSize)
+			if err != nil {
+				if rerr := tx.Rollback(); rerr != nil {
+					return fmt.Errorf("%w: %w: %w", ErrFailedRollback,
+						rerr, err)
+				}
+
+				return err
+			}
+
+			if err := tx.Commit(); err != nil {
+				return fmt.Errorf("failed committing tx: %w", err)
+			}
+
+			if last == 0 {
+				break
+			}
+
+			after = last
+			total += updated
+		}
+
+		slog.InfoContext(ctx, "RECOUNT", slog.Int64("updated", total))
+
+		w.Header().Set("Content-Type", "application/json")
+
+		err := json.NewEncoder(w).Encode(map[string]int64{"updated": total})
+		if err != nil {
+			return fmt.Errorf("failed encoding JSON: %w", err)
+		}
+
+		return nil
 	}
+}
 
-	params := map[string]interface{}{
-		"path": r.URL.Path,
-		"user": user,
-		"urls": urls,
+// purgeInterval is how often purgeLoop purges deleted URLs.
+const purgeInterval = time.Hour
+
+// purgeOnce permanently removes the URLs deleted more than age ago.
+func purgeOnce(ctx context.Context, db beginner, age time.Duration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed beginning tx: %w", err)
 	}
 
-	err = t.Execute(w, params)
+	purged, err := purgeDeleted(ctx, tx, now().Add(-age))
 	if err != nil {
-		return fmt.Errorf("failed executing template: %w", err)
+		if rerr := tx.Rollback(); rerr != nil {
+			return fmt.Errorf("%w: %w: %w", ErrFailedRollback, rerr, err)
+		}
+
+		return err
 	}
 
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed committing tx: %w", err)
+	}
+
+	slog.InfoContext(ctx, "PURGE", slog.Int64("purged", purged))
+
 	return nil
 }
 
-// validateAdminForm perform form parameter validation for admin page.
-func validateAdminForm(r *http.Request) (string, string, string, error) {
-	name := r.FormValue("name")
-	u := r.FormValue("url")
-	user := r.FormValue("user")
+// purgeLoop runs purgeOnce every purgeInterval, forever.
+func purgeLoop(db beginner, age time.Duration) {
+	ctx := context.Background()
+
+	for {
+		if err := purgeOnce(ctx, db, age); err != nil {
+			slog.ErrorContext(ctx, "error purging deleted URLs",
+				slog.Any("err", err))
+		}
 
-	if name == "" {
-		return "", "", "", ErrMissingName
+		time.Sleep(purgeInterval)
 	}
+}
 
-	if u == "" {
-		return "", "", "", ErrMissingURL
+// backupVersion is the version of the backup format, bumped on incompatible
+// changes.
+const backupVersion = 1
+
+// Restore strategies for URLs whose names are already taken.
+const (
+	restoreSkip      = "skip"
+	restoreOverwrite = "overwrite"
+	restoreFail      = "fail"
+)
+
+// restoreSummary tells what restoreHandler did.
+type restoreSummary struct {
+	Hits        int      `json:"hits"`
+	Overwritten []string `json:"overwritten,omitempty"`
+	Skipped     []string `json:"skipped,omitempty"`
+	URLs        int      `json:"urls"`
+}
+
+// backupRecord is a line of a backup. The first line only has the version,
+// the rest one of the others.
+type backupRecord struct {
+	Version int        `json:"version,omitempty"`
+	URL     *backupURL `json:"url,omitempty"`
+	Hit     *backupHit `json:"hit,omitempty"`
+}
+
+// backupHandler streams all URLs, and with hits=true their hits, as
+// newline-delimited JSON for restoreHandler. Admin only.
+func backupHandler(c *config) errorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+		tx := must(getTx(ctx))
+
+		if err := requireAdmin(ctx, c); err != nil {
+			return err
+		}
+
+		var withHits bool
+
+		if s := r.URL.Query().Get("hits"); s != "" {
+			var err error
+
+			withHits, err = strconv.ParseBool(s)
+			if err != nil {
+				return &HTTPError{ //nolint:exhaustruct
+					Code: http.StatusBadRequest,
+					Err:  err,
+				}
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		w.Header().Set("Content-Disposition",
+			`attachment; filename="urlredir.ndjson"`)
+
+		enc := json.NewEncoder(w)
+
+		//nolint:exhaustruct
+		if err := enc.Encode(backupRecord{Version: backupVersion}); err != nil {
+			return fmt.Errorf("failed encoding JSON: %w", err)
+		}
+
+		for u, err := range backupURLs(ctx, tx) {
+			if err != nil {
+				return err
+			}
+
+			//nolint:exhaustruct
+			if err := enc.Encode(backupRecord{URL: &u}); err != nil {
+				return fmt.Errorf("failed encoding JSON: %w", err)
+			}
+		}
+
+		if !withHits {
+			return nil
+		}
+
+		for h, err := range backupHits(ctx, tx) {
+			if err != nil {
+				return err
+			}
+
+			//nolint:exhaustruct
+			if err := enc.Encode(backupRecord{Hit: &h}); err != nil {
+				return fmt.Errorf("failed encoding JSON: %w", err)
+			}
+		}
+
+		return nil
+	}
+}
+
+// restoreHandler adds the URLs and hits of a backup made by backupHandler.
+// Admin only. The restore runs in one transaction with a savepoint per
+// c.ImportBatchSize records, so a failed restore leaves nothing behind. Taken
+// names are handled by the strategy parameter: skip (default) keeps the
+// existing URL, overwrite points it to the restored URL and fail aborts the
+// restore. Hits are only restored for URLs the restore added.
+func restoreHandler(c *config, db beginner) errorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+
+		if err := requireAdmin(ctx, c); err != nil {
+			return err
+		}
+
+		invalid := func(err error) error {
+			if !errors.Is(err, ErrInvalidBackup) {
+				err = fmt.Errorf("%w: %w", ErrInvalidBackup, err)
+			}
+
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Err:     err,
+				Message: ErrInvalidBackup.Error(),
+			}
+		}
+
+		strategy := cmp.Or(r.URL.Query().Get("strategy"), restoreSkip)
+
+		switch strategy {
+		case restoreSkip, restoreOverwrite, restoreFail:
+		default:
+			err := fmt.Errorf("%w: %s", ErrInvalidStrategy, strategy)
+
+			return &HTTPError{
+				Code:    http.StatusBadRequest,
+				Err:     err,
+				Message: err.Error(),
+			}
+		}
+
+		dec := json.NewDecoder(r.Body)
+
+		var header backupRecord
+
+		if err := dec.Decode(&header); err != nil {
+			return invalid(err)
+		}
+
+		if header.Version != backupVersion {
+			return invalid(fmt.Errorf("%w: unsupported version %d",
+				ErrInvalidBackup, header.Version))
+		}
+
+		tx, err := db.BeginTx(ctx, nil)
+		if err != nil {
+			return fmt.Errorf("failed beginning tx: %w", err)
+		}
+
+		rollback := func(err error) error {
+			if rerr := tx.Rollback(); rerr != nil {
+				return fmt.Errorf("%w: %w: %w", ErrFailedRollback, rerr,
+					err)
+			}
+
+			return err
+		}
+
+		var (
+			sum   restoreSummary
+			taken = map[string]bool{}
+		)
+
+		restoreLink := func(u backupURL) error {
+			err := withSavepoint(ctx, tx, func() error {
+				return restoreURL(ctx, tx, u)
+			})
+			if !isUniqueViolation(err) {
+				if err == nil {
+					sum.URLs++
+				}
+
+				return err
+			}
+
+			taken[u.Name] = true
+
+			switch strategy {
+			case restoreOverwrite:
+				sum.Overwritten = append(sum.Overwritten, u.Name)
+
+				return overwriteURL(ctx, tx, u)
+			case restoreFail:
+				return &HTTPError{
+					Code:    http.StatusConflict,
+					Err:     fmt.Errorf("%w: %s", ErrNameTaken, u.Name),
+					Message: ErrNameTaken.Error(),
+				}
+			default:
+				sum.Skipped = append(sum.Skipped, u.Name)
+
+				return nil
+			}
+		}
+
+		// batches are restored in savepoints of the one transaction, so a
+		// failed restore leaves nothing behind
+		restoreBatch := func() (bool, error) {
+			for range c.ImportBatchSize {
+				var rec backupRecord
+
+				err := dec.Decode(&rec)
+				if errors.Is(err, io.EOF) {
+					return true, nil
+				} else if err != nil {
+					return false, invalid(err)
+				}
+
+				switch {
+				case rec.URL != nil:
+					err = restoreLink(*rec.URL)
+				case rec.Hit != nil && taken[rec.Hit.Name]:
+					// the existing URL keeps its own hits
+				case rec.Hit != nil:
+					err = restoreHit(ctx, tx, *rec.Hit)
+					sum.Hits++
+				default:
+					err = fmt.Errorf("%w: empty record", ErrInvalidBackup)
+				}
+
+				if errors.Is(err, ErrInvalidBackup) {
+					return false, invalid(err)
+				} else if err != nil {
+					return false, err
+				}
+			}
+
+			return false, nil
+		}
+
+		for done := false; !done; {
+			if err := withSavepoint(ctx, tx, func() error {
+				var err error
+
+				done, err = restoreBatch()
+
+				return err
+			}); err != nil {
+				return rollback(err)
+			}
+
+			slog.InfoContext(ctx, "RESTORE progress",
+				slog.Int("urls", sum.URLs), slog.Int("hits", sum.Hits))
+		}
+
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("failed committing tx: %w", err)
+		}
+
+		slog.InfoContext(ctx, "RESTORE", slog.Int("urls", sum.URLs),
+			slog.Int("hits", sum.Hits), slog.String("strategy", strategy),
+			slog.Int("skipped", len(sum.Skipped)),
+			slog.Int("overwritten", len(sum.Overwritten)))
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(sum); err != nil {
+			return fmt.Errorf("failed encoding JSON: %w", err)
+		}
+
+		return nil
 	}
+}
+
+// maxNameAttempts is how many generated names are tried before giving up.
+const maxNameAttempts = 5
+
+// Generated names grow by a character once more than maxNameCollisionRate of
+// nameCollisionWindow tries collide.
+const (
+	nameCollisionWindow  = 20
+	maxNameCollisionRate = 0.25
+)
 
-	if _, err := url.Parse(u); err != nil {
-		return "", "", "", ErrInvalidURL
+// nameLength tracks collisions of generated names, growing them as names of
+// the current length run out. The growth lasts until restart. A nil
+// nameLength keeps the configured length.
+type nameLength struct {
+	mu sync.Mutex
+	// extra characters on top of the configured length
+	extra int
+	// tries and collisions since the last growth or full window
+	tries, collisions int
+}
+
+// get returns the length of the next generated name, at least minimum.
+func (l *nameLength) get(minimum int) int {
+	if l == nil {
+		return minimum
 	}
 
-	if user == "" {
-		return "", "", "", ErrMissingUser
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	return minimum + l.extra
+}
+
+// record counts a tried name, growing the length once a window of tries
+// collided too often.
+func (l *nameLength) record(collided bool) {
+	if l == nil {
+		return
 	}
 
-	return name, u, user, nil
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.tries++
+
+	if collided {
+		l.collisions++
+	}
+
+	if l.tries < nameCollisionWindow {
+		return
+	}
+
+	if float64(l.collisions) > maxNameCollisionRate*float64(l.tries) {
+		l.extra++
+	}
+
+	l.tries, l.collisions = 0, 0
 }
 
-// adminPostHandler inserts URLs to database.
-func adminPostHandler(w http.ResponseWriter, r *http.Request) error {
-	ctx := r.Context()
-	tx := must(getTx(ctx))
-	must(getUser(ctx))
+// randomName returns a random name of length characters from alphabet.
+func randomName(length int, alphabet string) string {
+	chars := []rune(alphabet)
+	name := make([]rune, length)
+	size := big.NewInt(int64(len(chars)))
 
-	name, u, user, err := validateAdminForm(r)
-	if err != nil {
-		return &HTTPError{
-			Code:    http.StatusBadRequest,
-			Err:     err,
-			Message: err.Error(),
+	for i := range name {
+		n, err := rand.Int(rand.Reader, size)
+		if err != nil {
+			panic(err)
 		}
+
+		name[i] = chars[n.Int64()]
 	}
 
-	if err := addURL(ctx, tx, name, u, user); err != nil {
-		return err
+	return string(name)
+}
+
+// generateName calls try with random names until one doesn't collide with an
+// existing name, and returns that name. Give up with ErrNameCollision after
+// maxNameAttempts. Names get longer with collisions, see nameLength.
+func generateName(c *config, try func(name string) error) (string, error) {
+	length := cmp.Or(c.GeneratedNameLength, defaultGeneratedNameLength)
+	alphabet := cmp.Or(c.GeneratedNameAlphabet, defaultNameAlphabet)
+
+	for range maxNameAttempts {
+		name := randomName(c.nameLength.get(length), alphabet)
+		if c.isReserved(name) {
+			continue
+		}
+
+		err := try(name)
+		if isUniqueViolation(err) {
+			c.nameLength.record(true)
+
+			continue
+		} else if err != nil {
+			return "", err
+		}
+
+		c.nameLength.record(false)
+
+		return name, nil
 	}
 
-	http.Redirect(w, r, "/_admin", http.StatusSeeOther)
+	return "", ErrNameCollision
+}
+
+// regenerateHandler gives the named URL a new random name, keeping the target
+// and hits, and responds with the new name as JSON. The old name redirects to
+// the new one for c.RegenerateGraceHours. Owner only.
+func regenerateHandler(c *config) errorHandler {
+	return func(w http.ResponseWriter, r *http.Request) error {
+		ctx := r.Context()
+		tx := must(getTx(ctx))
 
-	return nil
+		if err := parseForm(r); err != nil {
+			return err
+		}
+
+		name := r.FormValue("name")
+		if name == "" {
+			return &HTTPError{ //nolint:exhaustruct
+				Code: http.StatusBadRequest,
+				Err:  ErrMissingName,
+			}
+		}
+
+		id, err := ownedURLID(ctx, tx, name)
+		if err != nil {
+			return err
+		}
+
+		newName, err := generateName(c, func(name string) error {
+			return withSavepoint(ctx, tx, func() error {
+				return renameURL(ctx, tx, id, name)
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		if c.RegenerateGraceHours > 0 {
+			if err := addAlias(ctx, tx, name, id, now().Add(
+				time.Duration(c.RegenerateGraceHours)*time.Hour)); err != nil {
+				return err
+			}
+		}
+
+		if err := audit(r, tx, auditRegenerate, name); err != nil {
+			return err
+		}
+
+		slog.InfoContext(ctx, "REGENERATE", slog.String("name", name),
+			slog.String("new", newName))
+
+		w.Header().Set("Content-Type", "application/json")
+
+		if err := json.NewEncoder(w).Encode(map[string]string{
+			"name": newName,
+		}); err != nil {
+			return fmt.Errorf("failed encoding JSON: %w", err)
+		}
+
+		return nil
+	}
 }
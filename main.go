@@ -3,17 +3,41 @@
 package main
 
 import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/tls"
 	"database/sql"
 	"encoding/json"
+	"errors"
 	"expvar"
+	"flag"
+	"fmt"
 	"io"
+	"io/fs"
 	"log/slog"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"reflect"
 	"runtime/debug"
+	"slices"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"syscall"
 	"time"
+	"unicode"
+	"unicode/utf8"
 
+	"github.com/BurntSushi/toml"
 	_ "github.com/lib/pq"
+	"go.opentelemetry.io/otel"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"gopkg.in/yaml.v3"
 )
 
 // config is the (un)serializable config for urlredir.
@@ -28,8 +52,215 @@ type config struct {
 	RealIPHeader string
 	// RemoteUserHeader it he name of the header where proxy supplies user
 	RemoteUserHeader string
+	// AdminTemplate is an optional path to an external admin page template
+	AdminTemplate string
+	// AdminTemplatesByHost are paths to admin page templates by Host,
+	// falling back to AdminTemplate
+	AdminTemplatesByHost map[string]string
+	// JSRedirect redirects using JavaScript to forward URL fragments
+	JSRedirect bool
+	// MaxLinksPerUser is the default maximum number of URLs per user, 0 for
+	// unlimited
+	MaxLinksPerUser int
+	// AdminUsers are the users allowed to perform administrative tasks
+	AdminUsers []string
+	// CanonicalHost is the host other hosts are redirected to, if set
+	CanonicalHost string
+	// MaxURLLength is the maximum length of target URLs, 0 for unlimited
+	MaxURLLength int
+	// ReferrerPolicy is which referrers to record: all (default),
+	// cross-site, same-site or none
+	ReferrerPolicy string
+	// DefaultUser is the user when RemoteUserHeader is not set
+	DefaultUser string
+	// ListTimeoutSeconds limits the duration of listing queries, 0 for none
+	ListTimeoutSeconds int
+	// InjectCredentials adds stored credentials to redirect targets. They are
+	// exposed to anyone following the link in the Location header
+	InjectCredentials bool
+	// HitWriteMode is strict (default) to fail redirects when recording the
+	// hit fails, or best-effort to only log the failure
+	HitWriteMode string
+	// PreviewBody adds a body with OpenGraph tags to redirects for link
+	// unfurlers
+	PreviewBody bool
+	// LogAPIBodies logs request bodies of API calls when Debug is set
+	LogAPIBodies bool
+	// ApplicationName identifies the DB connections, e.g. in
+	// pg_stat_activity, unless already set in DB
+	ApplicationName string
+	// IdempotentDelete responds 204 instead of 404 to deleting missing URLs
+	IdempotentDelete bool
+	// ImportBatchSize is the number of records restored at a time, in a
+	// savepoint of the transaction of the restore
+	ImportBatchSize int
+	// TargetHostAllow lists the hosts links may point to, all if empty.
+	// "*.example.com" matches the subdomains of example.com
+	TargetHostAllow []string
+	// TargetHostDeny lists the hosts links may not point to, overriding
+	// TargetHostAllow
+	TargetHostDeny []string
+	// HSTSMaxAge is the max-age of the Strict-Transport-Security header sent
+	// over TLS, 0 for no header
+	HSTSMaxAge int
+	// HSTSIncludeSubDomains extends HSTS to subdomains
+	HSTSIncludeSubDomains bool
+	// HSTSPreload allows preloading HSTS into browsers
+	HSTSPreload bool
+	// MaxConcurrentPerIP limits in-flight redirects per client IP, 0 for
+	// unlimited
+	MaxConcurrentPerIP int
+	// NotFoundRedirect is where unknown names are redirected, 404 if empty
+	NotFoundRedirect string
+	// RedirectCode is the status of redirects: 301, 302 (default), 307 or 308.
+	// Only 301 redirects are cached by clients
+	RedirectCode int
+	// PassQuery adds the query parameters of requests to redirect targets
+	PassQuery bool
+	// ForceOwnerFromContext makes the user creating a link its owner even
+	// if it's an admin, ignoring the user in the admin form
+	ForceOwnerFromContext bool
+	// GoneWhenExhausted responds 410 instead of 404 to links out of hits
+	GoneWhenExhausted bool
+	// CookieSecret signs cookies of unlocked password protected links,
+	// random per start if empty
+	CookieSecret string
+	// AllowedSchemes lists the schemes links may use, http and https if
+	// empty
+	AllowedSchemes []string
+	// GeneratedNameLength is the length of names generated for links added
+	// without one, growing as generated names collide more often
+	GeneratedNameLength int
+	// GeneratedNameAlphabet are the characters of generated names
+	GeneratedNameAlphabet string
+	// ReservedNames can't be used for links, in addition to the names of
+	// routes. Links below them, e.g. "_admin/x", can't be used either
+	ReservedNames []string
+	// CSRFKey signs the CSRF tokens of the admin page, random per start if
+	// empty
+	CSRFKey string
+	// RateLimitRPS limits the redirects and deletions per second of each
+	// client IP, 0 for no limit
+	RateLimitRPS int
+	// RateLimitBurst is the number of requests a client may burst,
+	// RateLimitRPS if 0
+	RateLimitBurst int
+	// ReuseDeletedNames lets new links take the names of deleted links,
+	// which are otherwise kept until purged
+	ReuseDeletedNames bool
+	// PurgeDeletedAfterDays is the number of days deleted links and their
+	// hits are kept, 0 for forever
+	PurgeDeletedAfterDays int
+	// ReadReplica is the connection string of a read replica for stats and
+	// listings, empty to read from DB
+	ReadReplica string
+	// DBMaxOpenConns limits the open connections per pool, 0 for unlimited
+	DBMaxOpenConns int
+	// DBMaxIdleConns is the number of idle connections kept per pool, 0 for
+	// the driver default
+	DBMaxIdleConns int
+	// DBConnMaxLifetimeSeconds closes connections older than this, 0 for
+	// never
+	DBConnMaxLifetimeSeconds int
+	// DBConnMaxIdleTimeSeconds closes connections idle for longer than this,
+	// 0 for never
+	DBConnMaxIdleTimeSeconds int
+	// TLSCert and TLSKey are the files of the certificate chain and private
+	// key for serving HTTPS on Listen, both empty for plain HTTP
+	TLSCert string
+	TLSKey  string
+	// TLSMinVersion is the oldest TLS version accepted for HTTPS: 1.0, 1.1,
+	// 1.2 or 1.3
+	TLSMinVersion string
+	// TLSCipherSuites limits TLS 1.2 and older to the named cipher suites,
+	// e.g. TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, empty for Go's defaults.
+	// TLS 1.3 suites aren't configurable
+	TLSCipherSuites []string
+	// HTTPRedirectListen is an extra plain HTTP listen address redirecting
+	// to HTTPS on Listen, empty for none
+	HTTPRedirectListen string
+	// TracingEndpoint is the OTLP/HTTP URL traces are sent to, e.g.
+	// http://localhost:4318/v1/traces, empty to disable tracing
+	TracingEndpoint string
+	// CORSAllowedOrigins are the origins of browser based API clients, e.g.
+	// https://app.example.com, https://*.example.com or *, empty to disable
+	// CORS
+	CORSAllowedOrigins []string
+	// CORSAllowedMethods and CORSAllowedHeaders are what the API clients may
+	// send
+	CORSAllowedMethods []string
+	CORSAllowedHeaders []string
+	// BaseURL is the external address of this service, e.g.
+	// https://s.example.com, empty to use the request host
+	BaseURL string
+	// QRSize is the width and height of QR code images in pixels
+	QRSize int
+	// QRRecoveryLevel is the error correction level of QR codes: L, M, Q or
+	// H, from 7% to 30% of the code recoverable
+	QRRecoveryLevel string
+	// RegenerateGraceHours is how long the old name of a link given a new
+	// one keeps redirecting to it, 0 for not at all
+	RegenerateGraceHours int
+	// ExpiryGraceSeconds is how long expired links keep redirecting, with a
+	// warning logged, 0 for not at all
+	ExpiryGraceSeconds int
+	// HitAlertWebhook is the URL an alert is posted to, once, when a link
+	// reaches HitAlertPercent of its maximum hits, e.g. a Slack incoming
+	// webhook, empty to disable
+	HitAlertWebhook string
+	// HitAlertPercent is the share of the maximum hits alerted about
+	HitAlertPercent int
+
+	// routeNames are names shadowed by routes, set up by setupServeMux
+	routeNames []string
+	// nameLength grows generated names, set up by setupServeMux
+	nameLength *nameLength
 }
 
+const (
+	// defaultMaxURLLength is a generous limit real URLs stay well within.
+	defaultMaxURLLength = 2048
+	// defaultUser is the default user without RemoteUserHeader.
+	defaultUser = "test"
+	// defaultListTimeoutSeconds is long enough for any reasonable listing.
+	defaultListTimeoutSeconds = 10
+	// availableRPS and availableBurst limit name enumeration.
+	availableRPS   = 1
+	availableBurst = 10
+	// defaultApplicationName is the name of this service.
+	defaultApplicationName = "urlredir"
+	// defaultImportBatchSize keeps savepoints small during restores.
+	defaultImportBatchSize = 1000
+	// defaultRedirectCode keeps browsers from caching redirects for good.
+	defaultRedirectCode = http.StatusFound
+	// maxLoggedBody is the most of a request body logged by LogAPIBodies.
+	maxLoggedBody = 4096
+	// maxAPIBody is the largest accepted JSON request body.
+	maxAPIBody = 16 << 10
+	// shutdownTimeout is how long requests in flight may take on shutdown.
+	shutdownTimeout = 30 * time.Second
+	// readyTimeout keeps readiness probes fast when the DB hangs.
+	readyTimeout = 2 * time.Second
+	// defaultGeneratedNameLength is short, yet hard to guess.
+	defaultGeneratedNameLength = 6
+	// defaultNameAlphabet has no easily confused characters like 0/O and
+	// 1/l.
+	defaultNameAlphabet = "23456789abcdefghijkmnpqrstuvwxyz"
+	// defaultQRSize prints well on paper.
+	defaultQRSize = 256
+	// minQRSize and maxQRSize keep QR codes scannable and cheap to render.
+	minQRSize = 64
+	maxQRSize = 2048
+	// defaultHitAlertPercent leaves time to raise the limit.
+	defaultHitAlertPercent = 90
+	// defaultQRRecoveryLevel survives some smudging.
+	defaultQRRecoveryLevel = "M"
+	// defaultTLSMinVersion leaves out the deprecated TLS 1.0 and 1.1.
+	defaultTLSMinVersion = "1.2"
+	// redactedSecret replaces secrets in the published config.
+	redactedSecret = "xxxxx"
+)
+
 //nolint:gochecknoglobals
 var (
 	gitRev    string
@@ -38,10 +269,32 @@ var (
 	goVersion string
 	conf      config
 	pool      *sql.DB
+	// liveConfig is the config of the latest reload, see reloadConfig
+	liveConfig atomic.Pointer[config]
+	// logLevel is the level of the default logger, see setLogLevel
+	logLevel = new(slog.LevelVar)
+	// defaultAllowedSchemes keep links from running scripts when clicked
+	defaultAllowedSchemes = []string{"http", "https"}
+	// now is the clock for time-dependent logic, replaceable in tests
+	now = time.Now
 )
 
-// String implements Stringer for expvar, returns JSON.
+// String implements Stringer for expvar, returns JSON. Secrets are masked
+// like passwords by redactURL, as expvar serves them without authentication.
 func (c config) String() string {
+	if c.CookieSecret != "" {
+		c.CookieSecret = redactedSecret
+	}
+
+	if c.CSRFKey != "" {
+		c.CSRFKey = redactedSecret
+	}
+
+	// webhooks like Slack's have the token in the URL
+	if c.HitAlertWebhook != "" {
+		c.HitAlertWebhook = redactedSecret
+	}
+
 	b, err := json.Marshal(c) //nolint:musttag
 	if err != nil {
 		panic(err)
@@ -50,26 +303,534 @@ func (c config) String() string {
 	return string(b)
 }
 
-// readConfigFile reads config from file.
-func readConfigFile(name string, conf *config) {
+// isAdmin tells whether user is one of the configured admins.
+func (c *config) isAdmin(user string) bool {
+	return user != "" && slices.Contains(c.AdminUsers, user)
+}
+
+// isReserved tells whether name, or its first path segment, is shadowed by a
+// route or reserved in the config.
+func (c *config) isReserved(name string) bool {
+	first, _, _ := strings.Cut(name, "/")
+
+	return slices.Contains(c.routeNames, first) ||
+		slices.Contains(c.ReservedNames, first)
+}
+
+// targetHostAllowed tells whether links may point to host.
+func (c *config) targetHostAllowed(host string) bool {
+	matches := func(pattern string) bool { return hostMatches(pattern, host) }
+
+	if slices.ContainsFunc(c.TargetHostDeny, matches) {
+		return false
+	}
+
+	return len(c.TargetHostAllow) == 0 ||
+		slices.ContainsFunc(c.TargetHostAllow, matches)
+}
+
+// schemeAllowed tells whether links may use scheme.
+func (c *config) schemeAllowed(scheme string) bool {
+	schemes := c.AllowedSchemes
+	if len(schemes) == 0 {
+		schemes = defaultAllowedSchemes
+	}
+
+	return slices.ContainsFunc(schemes, func(s string) bool {
+		return strings.EqualFold(s, scheme)
+	})
+}
+
+// validHeaderName tells whether name is a valid HTTP header field name, a
+// token of RFC 9110.
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+
+	for _, r := range name {
+		if r > unicode.MaxASCII || !(unicode.IsLetter(r) ||
+			unicode.IsDigit(r) || strings.ContainsRune("!#$%&'*+-.^_`|~", r)) {
+			return false
+		}
+	}
+
+	return true
+}
+
+// validate checks the settings that would otherwise only fail once in use,
+// returning all problems at once.
+func (c *config) validate() error {
+	var errs []error
+
+	if _, port, err := net.SplitHostPort(c.Listen); err != nil {
+		errs = append(errs, fmt.Errorf("%w: Listen %q is not host:port: %w",
+			ErrInvalidConfig, c.Listen, err))
+	} else if _, err := net.LookupPort("tcp", port); err != nil {
+		errs = append(errs, fmt.Errorf("%w: Listen %q has invalid port: %w",
+			ErrInvalidConfig, c.Listen, err))
+	}
+
+	if strings.TrimSpace(c.DB) == "" {
+		errs = append(errs, fmt.Errorf("%w: DB is empty", ErrInvalidConfig))
+	}
+
+	switch c.ReferrerPolicy {
+	case "", referrerAll, referrerCrossSite, referrerSameSite, referrerNone:
+	default:
+		errs = append(errs, fmt.Errorf("%w: ReferrerPolicy %q",
+			ErrInvalidConfig, c.ReferrerPolicy))
+	}
+
+	switch c.HitWriteMode {
+	case "", hitWriteStrict, hitWriteBestEffort:
+	default:
+		errs = append(errs, fmt.Errorf("%w: HitWriteMode %q", ErrInvalidConfig,
+			c.HitWriteMode))
+	}
+
+	if !isRedirectCode(c.RedirectCode) {
+		errs = append(errs, fmt.Errorf("%w: RedirectCode %d", ErrInvalidConfig,
+			c.RedirectCode))
+	}
+
+	if c.ImportBatchSize < 1 {
+		errs = append(errs, fmt.Errorf("%w: ImportBatchSize %d",
+			ErrInvalidConfig, c.ImportBatchSize))
+	}
+
+	if c.RateLimitRPS < 0 || c.RateLimitBurst < 0 {
+		errs = append(errs, fmt.Errorf("%w: RateLimitRPS %d, RateLimitBurst %d",
+			ErrInvalidConfig, c.RateLimitRPS, c.RateLimitBurst))
+	}
+
+	if c.PurgeDeletedAfterDays < 0 {
+		errs = append(errs, fmt.Errorf("%w: PurgeDeletedAfterDays %d",
+			ErrInvalidConfig, c.PurgeDeletedAfterDays))
+	}
+
+	if c.DBMaxOpenConns < 0 || c.DBMaxIdleConns < 0 ||
+		c.DBConnMaxLifetimeSeconds < 0 || c.DBConnMaxIdleTimeSeconds < 0 {
+		errs = append(errs, fmt.Errorf("%w: negative DB pool setting",
+			ErrInvalidConfig))
+	}
+
+	if c.GeneratedNameLength < 1 {
+		errs = append(errs, fmt.Errorf("%w: GeneratedNameLength %d",
+			ErrInvalidConfig, c.GeneratedNameLength))
+	}
+
+	if utf8.RuneCountInString(c.GeneratedNameAlphabet) < 2 {
+		errs = append(errs, fmt.Errorf(
+			"%w: GeneratedNameAlphabet %q needs at least two characters",
+			ErrInvalidConfig, c.GeneratedNameAlphabet))
+	}
+
+	if c.RemoteUserHeader == "" && c.DefaultUser == "" {
+		errs = append(errs, fmt.Errorf(
+			"%w: DefaultUser required without RemoteUserHeader",
+			ErrInvalidConfig))
+	}
+
+	if (c.TLSCert == "") != (c.TLSKey == "") {
+		errs = append(errs, fmt.Errorf(
+			"%w: TLSCert and TLSKey must be set together", ErrInvalidConfig))
+	}
+
+	if _, ok := tlsVersions[c.TLSMinVersion]; !ok {
+		errs = append(errs, fmt.Errorf(
+			"%w: TLSMinVersion %q is not 1.0, 1.1, 1.2 or 1.3",
+			ErrInvalidConfig, c.TLSMinVersion))
+	}
+
+	for _, name := range c.TLSCipherSuites {
+		if _, ok := cipherSuiteID(name); !ok {
+			errs = append(errs, fmt.Errorf(
+				"%w: TLSCipherSuites %q is not a secure cipher suite",
+				ErrInvalidConfig, name))
+		}
+	}
+
+	if c.BaseURL != "" {
+		if u, err := url.Parse(c.BaseURL); err != nil {
+			errs = append(errs, fmt.Errorf("%w: BaseURL %q is invalid: %w",
+				ErrInvalidConfig, c.BaseURL, err))
+		} else if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" ||
+			u.User != nil || u.RawQuery != "" || u.Fragment != "" {
+			errs = append(errs, fmt.Errorf(
+				"%w: BaseURL %q is not an absolute http(s) URL",
+				ErrInvalidConfig, c.BaseURL))
+		}
+	}
+
+	if c.QRSize < minQRSize || c.QRSize > maxQRSize {
+		errs = append(errs, fmt.Errorf("%w: QRSize %d is not from %d to %d",
+			ErrInvalidConfig, c.QRSize, minQRSize, maxQRSize))
+	}
+
+	if _, ok := qrRecoveryLevels[c.QRRecoveryLevel]; !ok {
+		errs = append(errs, fmt.Errorf(
+			"%w: QRRecoveryLevel %q is not L, M, Q or H", ErrInvalidConfig,
+			c.QRRecoveryLevel))
+	}
+
+	if c.RegenerateGraceHours < 0 {
+		errs = append(errs, fmt.Errorf("%w: RegenerateGraceHours %d is negative",
+			ErrInvalidConfig, c.RegenerateGraceHours))
+	}
+
+	if c.ExpiryGraceSeconds < 0 {
+		errs = append(errs, fmt.Errorf("%w: ExpiryGraceSeconds %d is negative",
+			ErrInvalidConfig, c.ExpiryGraceSeconds))
+	}
+
+	if c.HitAlertWebhook != "" {
+		// not quoted, as it may have a token
+		if u, err := url.Parse(c.HitAlertWebhook); err != nil ||
+			(u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			errs = append(errs, fmt.Errorf(
+				"%w: HitAlertWebhook is not an absolute http(s) URL",
+				ErrInvalidConfig))
+		}
+
+		if c.HitAlertPercent < 1 || c.HitAlertPercent > 100 {
+			errs = append(errs, fmt.Errorf(
+				"%w: HitAlertPercent %d is not from 1 to 100",
+				ErrInvalidConfig, c.HitAlertPercent))
+		}
+	}
+
+	if c.HTTPRedirectListen != "" {
+		if !useTLS(c) {
+			errs = append(errs, fmt.Errorf(
+				"%w: HTTPRedirectListen requires TLSCert and TLSKey",
+				ErrInvalidConfig))
+		}
+
+		if _, _, err := net.SplitHostPort(c.HTTPRedirectListen); err != nil {
+			errs = append(errs, fmt.Errorf(
+				"%w: HTTPRedirectListen %q is not host:port: %w",
+				ErrInvalidConfig, c.HTTPRedirectListen, err))
+		}
+	}
+
+	for _, h := range []struct{ field, name string }{
+		{"RealIPHeader", c.RealIPHeader},
+		{"RemoteUserHeader", c.RemoteUserHeader},
+	} {
+		if h.name != "" && !validHeaderName(h.name) {
+			errs = append(errs, fmt.Errorf("%w: %s %q is not a header name",
+				ErrInvalidConfig, h.field, h.name))
+		}
+	}
+
+	if c.RealIPHeader != "" &&
+		strings.EqualFold(c.RealIPHeader, c.RemoteUserHeader) {
+		errs = append(errs, fmt.Errorf(
+			"%w: RealIPHeader and RemoteUserHeader are both %q",
+			ErrInvalidConfig, c.RealIPHeader))
+	}
+
+	return errors.Join(errs...)
+}
+
+// useTLS tells whether c has a certificate and key for serving HTTPS.
+func useTLS(c *config) bool {
+	return c.TLSCert != "" && c.TLSKey != ""
+}
+
+// tlsVersions are the TLS versions by name.
+//
+//nolint:gochecknoglobals
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// cipherSuiteID returns the ID of the named cipher suite, if it is one of the
+// secure suites implemented by crypto/tls.
+func cipherSuiteID(name string) (uint16, bool) {
+	for _, suite := range tls.CipherSuites() {
+		if suite.Name == name {
+			return suite.ID, true
+		}
+	}
+
+	return 0, false
+}
+
+// tlsConfig returns the TLS settings of c for serving HTTPS. c must be valid.
+func tlsConfig(c *config) *tls.Config {
+	tc := &tls.Config{ //nolint:exhaustruct
+		MinVersion: tlsVersions[c.TLSMinVersion],
+	}
+
+	for _, name := range c.TLSCipherSuites {
+		id, _ := cipherSuiteID(name)
+		tc.CipherSuites = append(tc.CipherSuites, id)
+	}
+
+	return tc
+}
+
+// serve accepts connections on ln for srv, over TLS if c has a certificate
+// and key, see useTLS.
+func serve(srv *http.Server, ln net.Listener, c *config) error {
+	if useTLS(c) {
+		srv.TLSConfig = tlsConfig(c)
+
+		return srv.ServeTLS(ln, c.TLSCert, c.TLSKey) //nolint:wrapcheck
+	}
+
+	return srv.Serve(ln) //nolint:wrapcheck
+}
+
+// httpsRedirectHandler permanently redirects requests to the same URL over
+// HTTPS on the port of listen.
+func httpsRedirectHandler(listen string) http.Handler {
+	_, port, _ := net.SplitHostPort(listen)
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+
+		if port != "" && port != "443" && port != "https" {
+			host = net.JoinHostPort(host, port)
+		}
+
+		u := *r.URL
+		u.Scheme = "https"
+		u.Host = host
+
+		http.Redirect(w, r, u.String(), http.StatusMovedPermanently)
+	})
+}
+
+// hstsValue returns the Strict-Transport-Security header value for c.
+func hstsValue(c *config) string {
+	value := fmt.Sprintf("max-age=%d", c.HSTSMaxAge)
+
+	if c.HSTSIncludeSubDomains {
+		value += "; includeSubDomains"
+	}
+
+	if c.HSTSPreload {
+		value += "; preload"
+	}
+
+	return value
+}
+
+// loadConfigFile decodes config from file in the format given by its
+// extension, see configToJSON. Without the file, config comes from the
+// defaults and the environment alone.
+func loadConfigFile(name string, conf *config) error {
 	cfile, err := os.Open(name)
+	if errors.Is(err, fs.ErrNotExist) {
+		slog.Warn("no config file, using environment",
+			slog.String("file", name))
+
+		return decodeConfig(strings.NewReader("{}"), conf)
+	} else if err != nil {
+		return fmt.Errorf("failed opening config file: %w", err)
+	}
+
+	defer cfile.Close()
+
+	r, err := configToJSON(name, cfile)
 	if err != nil {
-		slog.Error("error opening config file", slog.Any("err", err))
+		return err
+	}
+
+	return decodeConfig(r, conf)
+}
+
+// readConfigFile reads config from file, see loadConfigFile, exiting if it's
+// invalid.
+func readConfigFile(name string, conf *config) {
+	if err := loadConfigFile(name, conf); err != nil {
+		slog.Error("error reading config file", slog.String("file", name),
+			slog.Any("err", err))
 		os.Exit(1)
 	}
 
-	readConfig(cfile, conf)
+	readBuildInfo()
 }
 
-// readConfig reads config from io.Reader.
-func readConfig(cfile io.Reader, conf *config) {
-	var err error
+// configToJSON converts a .json, .yaml, .yml or .toml config file to JSON, so
+// that all formats are decoded into config alike.
+func configToJSON(name string, r io.Reader) (io.Reader, error) {
+	var v map[string]any
+
+	switch ext := strings.ToLower(filepath.Ext(name)); ext {
+	case ".json":
+		return r, nil
+	case ".yaml", ".yml":
+		if err := yaml.NewDecoder(r).Decode(&v); err != nil &&
+			!errors.Is(err, io.EOF) {
+			return nil, fmt.Errorf("failed decoding YAML: %w", err)
+		}
+	case ".toml":
+		if _, err := toml.NewDecoder(r).Decode(&v); err != nil {
+			return nil, fmt.Errorf("failed decoding TOML: %w", err)
+		}
+	default:
+		return nil, fmt.Errorf("%w: %q, use .json, .yaml or .toml",
+			ErrConfigFormat, ext)
+	}
+
+	b, err := json.Marshal(v)
+	if err != nil {
+		return nil, fmt.Errorf("failed encoding JSON: %w", err)
+	}
+
+	return bytes.NewReader(b), nil
+}
+
+// envPrefix starts the names of environment variables overriding config.
+const envPrefix = "URLREDIR_"
+
+// envName returns the environment variable overriding the config field, e.g.
+// URLREDIR_REMOTE_USER_HEADER for RemoteUserHeader and URLREDIR_HSTS_MAX_AGE
+// for HSTSMaxAge.
+func envName(field string) string {
+	var sb strings.Builder
+
+	sb.WriteString(envPrefix)
+
+	runes := []rune(field)
+
+	for i, r := range runes {
+		// a word starts at an upper case letter after a lower case one, or
+		// before one when ending an acronym
+		if i > 0 && unicode.IsUpper(r) && (!unicode.IsUpper(runes[i-1]) ||
+			i+1 < len(runes) && unicode.IsLower(runes[i+1])) {
+			sb.WriteByte('_')
+		}
+
+		sb.WriteRune(unicode.ToUpper(r))
+	}
+
+	return sb.String()
+}
+
+// parseEnvBool parses booleans like true/false, 1/0 and yes/no.
+func parseEnvBool(value string) (bool, error) {
+	switch strings.ToLower(strings.TrimSpace(value)) {
+	case "true", "1", "yes":
+		return true, nil
+	case "false", "0", "no":
+		return false, nil
+	default:
+		return false, fmt.Errorf("%w: %s", ErrInvalidBool, value)
+	}
+}
+
+// applyEnv overrides the string, boolean, integer and list fields of conf with
+// the environment variables named by envName. Lists are comma separated.
+func applyEnv(conf *config) error {
+	v := reflect.ValueOf(conf).Elem()
+
+	for i := range v.NumField() {
+		field := v.Type().Field(i)
+		if !field.IsExported() {
+			continue
+		}
+
+		name := envName(field.Name)
+
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			continue
+		}
+
+		switch f := v.Field(i); f.Kind() { //nolint:exhaustive
+		case reflect.String:
+			f.SetString(value)
+		case reflect.Bool:
+			b, err := parseEnvBool(value)
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+
+			f.SetBool(b)
+		case reflect.Int:
+			n, err := strconv.Atoi(strings.TrimSpace(value))
+			if err != nil {
+				return fmt.Errorf("%s: %w", name, err)
+			}
+
+			f.SetInt(int64(n))
+		case reflect.Slice:
+			if field.Type.Elem().Kind() != reflect.String {
+				continue
+			}
+
+			var list []string
+
+			for _, s := range strings.Split(value, ",") {
+				if s = strings.TrimSpace(s); s != "" {
+					list = append(list, s)
+				}
+			}
+
+			f.Set(reflect.ValueOf(list))
+		default:
+			slog.Warn("config field can't be set from environment",
+				slog.String("env", name))
+		}
+	}
+
+	return nil
+}
+
+// decodeConfig decodes config from io.Reader on top of the defaults and
+// applies the environment. The result is checked by validate.
+func decodeConfig(cfile io.Reader, conf *config) error {
+	conf.MaxURLLength = defaultMaxURLLength
+	conf.DefaultUser = defaultUser
+	conf.ListTimeoutSeconds = defaultListTimeoutSeconds
+	conf.ApplicationName = defaultApplicationName
+	conf.ImportBatchSize = defaultImportBatchSize
+	conf.RedirectCode = defaultRedirectCode
+	conf.GeneratedNameLength = defaultGeneratedNameLength
+	conf.GeneratedNameAlphabet = defaultNameAlphabet
+	conf.ReservedNames = []string{"_admin", "debug"}
+	conf.CORSAllowedMethods = []string{http.MethodGet, http.MethodPost}
+	conf.CORSAllowedHeaders = []string{"Authorization", "Content-Type"}
+	conf.QRSize = defaultQRSize
+	conf.QRRecoveryLevel = defaultQRRecoveryLevel
+	conf.HitAlertPercent = defaultHitAlertPercent
+	conf.TLSMinVersion = defaultTLSMinVersion
+
 	//nolint:musttag
-	if err = json.NewDecoder(cfile).Decode(conf); err != nil {
-		slog.Error("failed to decode config", slog.Any("err", err))
+	if err := json.NewDecoder(cfile).Decode(conf); err != nil {
+		return fmt.Errorf("failed to decode config: %w", err)
+	}
+
+	if err := applyEnv(conf); err != nil {
+		return fmt.Errorf("%w from environment: %w", ErrInvalidConfig, err)
+	}
+
+	return nil
+}
+
+// readConfig reads config from io.Reader, exiting if it's invalid.
+func readConfig(cfile io.Reader, conf *config) {
+	if err := decodeConfig(cfile, conf); err != nil {
+		slog.Error("invalid config", slog.Any("err", err))
 		os.Exit(1)
 	}
 
+	readBuildInfo()
+}
+
+// readBuildInfo sets the version information from the build.
+func readBuildInfo() {
 	binfo, ok := debug.ReadBuildInfo()
 	if ok {
 		goVersion = binfo.GoVersion
@@ -95,43 +856,289 @@ func readConfig(cfile io.Reader, conf *config) {
 	}
 }
 
+// liveConf returns the config of the latest reload, or conf before any.
+func liveConf() *config {
+	if c := liveConfig.Load(); c != nil {
+		return c
+	}
+
+	return &conf
+}
+
+// setLogLevel logs debug messages if debug is set.
+func setLogLevel(debug bool) {
+	if debug {
+		logLevel.Set(slog.LevelDebug)
+	} else {
+		logLevel.Set(slog.LevelInfo)
+	}
+}
+
+// reloadConfig reads the config file again. Debug, RealIPHeader,
+// RemoteUserHeader and the rate limits take effect for new requests, changes
+// to other settings are logged as ignored until restart. An invalid file
+// leaves the config as it was.
+func reloadConfig(name string) error {
+	var next config
+
+	if err := loadConfigFile(name, &next); err != nil {
+		return err
+	}
+
+	if err := next.validate(); err != nil {
+		return err
+	}
+
+	live := *liveConf()
+	live.Debug = next.Debug
+	live.RealIPHeader = next.RealIPHeader
+	live.RemoteUserHeader = next.RemoteUserHeader
+	live.RateLimitRPS = next.RateLimitRPS
+	live.RateLimitBurst = next.RateLimitBurst
+
+	lv, nv := reflect.ValueOf(live), reflect.ValueOf(next)
+
+	for i := range lv.NumField() {
+		field := lv.Type().Field(i)
+
+		if field.IsExported() && !reflect.DeepEqual(lv.Field(i).Interface(),
+			nv.Field(i).Interface()) {
+			slog.Warn("config change ignored until restart",
+				slog.String("field", field.Name))
+		}
+	}
+
+	liveConfig.Store(&live)
+	setLogLevel(live.Debug)
+
+	slog.Info("config reloaded", slog.String("file", name))
+
+	return nil
+}
+
+// logFeatures logs which optional features are enabled by c.
+func logFeatures(c *config) {
+	slog.Info("Features",
+		slog.Bool("debug", c.Debug),
+		slog.Bool("realIP", c.RealIPHeader != ""),
+		slog.Bool("remoteUser", c.RemoteUserHeader != ""),
+		slog.Bool("canonicalHost", c.CanonicalHost != ""),
+		slog.Bool("hsts", c.HSTSMaxAge > 0),
+		slog.Bool("jsRedirect", c.JSRedirect),
+		slog.Bool("previewBody", c.PreviewBody),
+		slog.Bool("injectCredentials", c.InjectCredentials),
+		slog.Bool("quota", c.MaxLinksPerUser > 0),
+		slog.Bool("concurrencyLimit", c.MaxConcurrentPerIP > 0),
+		slog.Bool("referrers", c.ReferrerPolicy != referrerNone),
+		slog.Bool("bestEffortHits", c.HitWriteMode == hitWriteBestEffort),
+		slog.Bool("logAPIBodies", c.Debug && c.LogAPIBodies),
+		slog.Bool("tracing", c.TracingEndpoint != ""))
+}
+
 // setupServeMux returns a set up http.Handler.
-func setupServeMux(db *sql.DB) http.Handler {
-	mux := http.NewServeMux()
+func setupServeMux(db, replica *sql.DB) http.Handler {
+	mux := &routeMux{ServeMux: http.NewServeMux()} //nolint:exhaustruct
 
 	if conf.Debug {
 		expvar.NewString("gitrev").Set(gitRev)
 		expvar.NewString("gitDirty").Set(gitDirty)
 		expvar.NewString("revdate").Set(revDate.Format(time.RFC3339))
 		expvar.Publish("config", conf)
+		expvar.Publish("db", expvar.Func(func() any {
+			return db.Stats()
+		}))
+
+		if replica != nil {
+			expvar.Publish("replica", expvar.Func(func() any {
+				return replica.Stats()
+			}))
+		}
 
 		mux.Handle("GET /debug/vars", expvar.Handler())
 	}
 
-	mws := chain{panicMiddleware, loggerMiddleware, dbMiddleware(db)}
+	base := chain{requestIDMiddleware, panicMiddleware, loggerMiddleware}
 
-	if conf.RealIPHeader != "" {
-		mws = append(mws, realIPMiddleware(conf.RealIPHeader))
+	if conf.TracingEndpoint != "" {
+		base = append(base, otelMiddleware(otel.GetTracerProvider()))
 	}
 
-	if conf.RemoteUserHeader != "" {
-		mws = append(mws, remoteUserMiddleware(conf.RemoteUserHeader))
-	} else {
-		mws = append(mws, staticUserMiddleware("test"))
+	if conf.HSTSMaxAge > 0 {
+		base = append(base, hstsMiddleware(hstsValue(&conf)))
+	}
+
+	mux.Handle("GET /version", base.applyE(versionHandler))
+
+	// probes are frequent, so they are not logged
+	probe := chain{panicMiddleware}
+	mux.Handle("GET /healthz", probe.apply(http.HandlerFunc(healthzHandler)))
+	mux.Handle("GET /readyz", probe.applyE(readyzHandler(db)))
+
+	pre := slices.Clone(base)
+
+	// only the routes using pre, not e.g. /debug/vars
+	if conf.CanonicalHost != "" {
+		pre = append(pre, canonicalHostMiddleware(conf.CanonicalHost))
 	}
 
-	mux.Handle("GET /{name}", mws.applyE(redirHandler))
-	mux.Handle("DELETE /{name}", mws.applyE(deleteHandler))
-	mux.Handle("GET /_admin", mws.applyE(adminGetHandler))
-	mux.Handle("POST /_admin", mws.applyE(adminPostHandler))
+	// api is added to the API routes, never the redirects
+	api := chain{compressMiddleware}
+
+	if conf.Debug && conf.LogAPIBodies {
+		api = append(api, bodyLogMiddleware(maxLoggedBody))
+	}
+
+	// cors is added to the API routes only, in front of authentication
+	cors := chain{}
+
+	if len(conf.CORSAllowedOrigins) > 0 {
+		cors = append(cors, corsMiddleware(conf.CORSAllowedOrigins,
+			conf.CORSAllowedMethods, conf.CORSAllowedHeaders))
+	}
+
+	apiPre := slices.Concat(pre, cors)
+
+	if len(cors) > 0 {
+		// preflight requests are answered by corsMiddleware
+		mux.Handle("OPTIONS /_api/", apiPre.applyE(
+			methodNotAllowedHandler(http.MethodGet, http.MethodPost)))
+	}
+
+	mux.Handle("GET /_api/reserved", slices.Concat(apiPre, api).
+		applyE(reservedHandler(&conf)))
+
+	// the client address and user headers follow config reloads
+	post := chain{
+		reloadable(func(c *config) middleware {
+			if c.RealIPHeader == "" {
+				return passMiddleware
+			}
 
-	return mux
+			return realIPMiddleware(c.RealIPHeader)
+		}),
+		reloadable(userMiddleware),
+		tokenAuthMiddleware(db),
+	}
+
+	// withDB returns the chains running handlers after pre in a transaction
+	// and read-only handlers on the replica, if there is one
+	withDB := func(pre chain) (chain, chain) {
+		mws := slices.Concat(pre, chain{dbMiddleware(db)}, post)
+		if replica == nil {
+			return mws, mws
+		}
+
+		return mws, slices.Concat(pre, chain{dbMiddleware(replicaDB{
+			replica: replica,
+			primary: db,
+		})}, post)
+	}
+
+	// mws runs handlers in a transaction, noTx leaves that to the handler
+	mws, reads := withDB(pre)
+	noTx := slices.Concat(pre, post)
+	apiMws, apiReads := withDB(apiPre)
+
+	mux.Handle("GET /_api/available", slices.Concat(apiMws,
+		chain{rateLimitMiddleware(availableRPS, availableBurst)}, api).
+		applyE(availableHandler(&conf)))
+	mux.Handle("GET /_api/summary", slices.Concat(apiReads, api).
+		applyE(summaryHandler))
+	mux.Handle("POST /_api/urls", slices.Concat(apiMws, api).
+		applyE(jsonErrors(apiCreateHandler(&conf))))
+	mux.Handle("GET /_api/urls/{name...}", slices.Concat(apiReads, api).
+		applyE(jsonErrors(apiGetHandler(&conf))))
+	mux.Handle("GET /_api/urls/{name}/hits", slices.Concat(apiReads, api).
+		applyE(jsonErrors(apiHitsHandler)))
+	mux.Handle("GET /_api/urls/{name}/stats/daily", slices.Concat(apiReads,
+		api).applyE(jsonErrors(apiDailyHandler)))
+	mux.Handle("GET /_api/urls/{name}/stats/referrers", slices.Concat(apiReads,
+		api).applyE(jsonErrors(apiReferrersHandler)))
+	mux.Handle("GET /_api/urls/{name}/stats/agents", slices.Concat(apiReads,
+		api).applyE(jsonErrors(apiAgentsHandler)))
+	mux.Handle("GET /_api/urls/{name}/hits.csv", slices.Concat(apiReads, api).
+		applyE(hitsCSVHandler))
+
+	// limited shares one rate limiter between redirects and deletions,
+	// replaced on config reloads
+	limited := slices.Concat(mws, chain{reloadable(func(c *config) middleware {
+		if c.RateLimitRPS == 0 {
+			return passMiddleware
+		}
+
+		return rateLimitMiddleware(c.RateLimitRPS,
+			cmp.Or(c.RateLimitBurst, c.RateLimitRPS))
+	})})
+
+	redir := limited
+
+	if conf.MaxConcurrentPerIP > 0 {
+		redir = slices.Concat(limited,
+			chain{concurrencyLimitMiddleware(conf.MaxConcurrentPerIP)})
+	}
+
+	redirect := redir.applyE(redirHandler(&conf))
+
+	mux.Handle("GET /{name}", redirect)
+	mux.Handle("GET /{name}/{rest...}", redirect)
+	// password protected links are unlocked by posting the password
+	mux.Handle("POST /{name}", redirect)
+	mux.Handle("POST /{name}/{rest...}", redirect)
+
+	csrf := chain{csrfMiddleware(secretOrRandom(conf.CSRFKey))}
+
+	mux.Handle("DELETE /{name}", slices.Concat(limited, csrf).
+		applyE(deleteHandler(&conf)))
+	mux.Handle("PUT /{name}", mws.applyE(updateHandler(&conf)))
+	mux.Handle("GET /{name}/hits.csv", reads.applyE(hitsCSVHandler))
+	// QR codes are as public as the links, see qrHandler
+	mux.Handle("GET /{name}/qr.png", reads.applyE(qrHandler(&conf)))
+	mux.Handle("PUT /{name}/acl/{user}", mws.applyE(aclHandler))
+	mux.Handle("DELETE /{name}/acl/{user}", mws.applyE(aclHandler))
+
+	themes := loadAdminThemes(conf.AdminTemplate,
+		conf.AdminTemplatesByHost)
+
+	mux.Handle("GET /_static/admin.js", base.apply(staticHandler("admin.js")))
+
+	admin := slices.Concat(mws, api)
+	adminReads := slices.Concat(reads, api)
+
+	mux.Handle("GET /_admin", slices.Concat(adminReads, csrf).
+		applyE(adminGetHandler(&conf, themes)))
+	mux.Handle("POST /_admin", slices.Concat(admin, csrf).
+		applyE(adminPostHandler(&conf)))
+	mux.Handle("POST /_admin/delete-batch", slices.Concat(admin, csrf).
+		applyE(deleteBatchHandler))
+	mux.Handle("POST /_admin/quota", slices.Concat(admin, csrf).
+		applyE(quotaHandler(&conf)))
+	mux.Handle("POST /_admin/regenerate", slices.Concat(admin, csrf).
+		applyE(regenerateHandler(&conf)))
+	mux.Handle("GET /_admin/top", adminReads.applyE(topHandler(&conf)))
+	mux.Handle("GET /_admin/audit", adminReads.applyE(auditHandler(&conf)))
+	mux.Handle("POST /_admin/undelete", slices.Concat(admin, csrf).
+		applyE(undeleteHandler(&conf)))
+	mux.Handle("POST /_admin/blocks", slices.Concat(admin, csrf).
+		applyE(blockHandler(&conf)))
+	mux.Handle("DELETE /_admin/blocks", slices.Concat(admin, csrf).
+		applyE(unblockHandler(&conf)))
+	mux.Handle("POST /_admin/tokens", slices.Concat(admin, csrf).
+		applyE(tokenHandler))
+	mux.Handle("GET /_admin/export", adminReads.applyE(exportHandler))
+	mux.Handle("GET /_admin/backup", adminReads.applyE(backupHandler(&conf)))
+	mux.Handle("POST /_admin/backup", slices.Concat(noTx, api, csrf).
+		applyE(restoreHandler(&conf, db)))
+	mux.Handle("POST /_admin/recount", slices.Concat(noTx, api, csrf).
+		applyE(recountHandler(&conf, db)))
+
+	conf.routeNames = routeNames(mux.patterns)
+	conf.nameLength = &nameLength{} //nolint:exhaustruct
+
+	return mux.ServeMux
 }
 
 // main should be kept small as it is hard to test.
 func main() {
-	logLevel := new(slog.LevelVar)
-
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr,
 		&slog.HandlerOptions{ //nolint:exhaustruct
 			AddSource: true,
@@ -140,10 +1147,29 @@ func main() {
 
 	var err error
 
-	readConfigFile("config.json", &conf)
+	configFile := flag.String("config", "config.json",
+		"config file, .json, .yaml or .toml")
+	flag.Parse()
 
-	if conf.Debug {
-		logLevel.Set(slog.LevelDebug)
+	readConfigFile(*configFile, &conf)
+
+	if err := conf.validate(); err != nil {
+		slog.Error("invalid config", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	setLogLevel(conf.Debug)
+
+	var tp *sdktrace.TracerProvider
+
+	if conf.TracingEndpoint != "" {
+		tp, err = newTracerProvider(context.Background(), &conf)
+		if err != nil {
+			slog.Error("error setting up tracing", slog.Any("err", err))
+			os.Exit(1)
+		}
+
+		otel.SetTracerProvider(tp)
 	}
 
 	pool, err = newPostgresDB()
@@ -152,12 +1178,34 @@ func main() {
 		os.Exit(1)
 	}
 
-	mux := setupServeMux(pool)
+	if err := prepareStatements(context.Background(), pool); err != nil {
+		slog.Error("error preparing statements", slog.Any("err", err))
+		os.Exit(1)
+	}
+
+	var replica *sql.DB
+
+	if conf.ReadReplica != "" {
+		replica, err = newReplicaDB(conf.ReadReplica)
+		if err != nil {
+			slog.Error("error opening read replica", slog.Any("err", err))
+			os.Exit(1)
+		}
+	}
+
+	mux := setupServeMux(pool, replica)
+
+	if conf.PurgeDeletedAfterDays > 0 {
+		go purgeLoop(pool,
+			time.Duration(conf.PurgeDeletedAfterDays)*24*time.Hour)
+	}
+
+	logFeatures(&conf)
 
 	slog.Info("Listening", slog.String("goversion", goVersion),
 		slog.String("gitRev", gitRev), slog.Any("revDate", revDate),
 		slog.String("gitDirty", gitDirty),
-		slog.String("addr", conf.Listen))
+		slog.String("addr", conf.Listen), slog.Bool("tls", useTLS(&conf)))
 
 	srv := &http.Server{ //nolint:exhaustruct
 		Handler:           mux,
@@ -168,8 +1216,97 @@ func main() {
 		Addr:              conf.Listen,
 	}
 
-	if err := srv.ListenAndServe(); err != nil {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt,
+		syscall.SIGTERM)
+	defer stop()
+
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	go func() {
+		for range hup {
+			if err := reloadConfig(*configFile); err != nil {
+				slog.Error("error reloading config", slog.Any("err", err))
+			}
+		}
+	}()
+
+	var redirSrv *http.Server
+
+	if conf.HTTPRedirectListen != "" {
+		redirSrv = &http.Server{ //nolint:exhaustruct
+			Handler:           httpsRedirectHandler(conf.Listen),
+			ReadTimeout:       time.Minute,
+			WriteTimeout:      time.Minute,
+			ReadHeaderTimeout: time.Minute,
+			IdleTimeout:       time.Minute,
+			Addr:              conf.HTTPRedirectListen,
+		}
+
+		go func() {
+			err := redirSrv.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				slog.Error("error listening for HTTPS redirects",
+					slog.Any("err", err))
+			}
+		}()
+	}
+
+	stopped := make(chan struct{})
+
+	go func() {
+		defer close(stopped)
+
+		<-ctx.Done()
+
+		ctx, cancel := context.WithTimeout(context.Background(),
+			shutdownTimeout)
+		defer cancel()
+
+		if redirSrv != nil {
+			if err := redirSrv.Shutdown(ctx); err != nil {
+				slog.Error("error shutting down HTTPS redirects",
+					slog.Any("err", err))
+			}
+		}
+
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Error("error shutting down", slog.Any("err", err))
+		}
+	}()
+
+	ln, err := net.Listen("tcp", conf.Listen)
+	if err != nil {
 		slog.Error("error listening", slog.Any("err", err))
+		os.Exit(1) //nolint:gocritic
+	}
+
+	if err := serve(srv, ln, &conf); !errors.Is(err, http.ErrServerClosed) {
+		slog.Error("error serving", slog.Any("err", err))
 		os.Exit(1)
 	}
+
+	<-stopped
+
+	closeStatements(statements)
+
+	if err := pool.Close(); err != nil {
+		slog.Error("error closing database", slog.Any("err", err))
+	}
+
+	if replica != nil {
+		if err := replica.Close(); err != nil {
+			slog.Error("error closing read replica", slog.Any("err", err))
+		}
+	}
+
+	if tp != nil {
+		ctx, cancel := context.WithTimeout(context.Background(),
+			shutdownTimeout)
+		defer cancel()
+
+		if err := tp.Shutdown(ctx); err != nil {
+			slog.Error("error flushing traces", slog.Any("err", err))
+		}
+	}
 }
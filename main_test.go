@@ -3,13 +3,29 @@
 package main
 
 import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
 	"flag"
+	"io"
 	"log/slog"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"reflect"
+	"slices"
 	"strings"
 	"testing"
+	"time"
 )
 
 func checkErr(tb testing.TB, err error) {
@@ -32,6 +48,10 @@ func TestMain(m *testing.M) {
 		if err != nil {
 			panic(err)
 		}
+
+		if err := prepareStatements(context.Background(), pool); err != nil {
+			panic(err)
+		}
 	}
 
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr,
@@ -52,11 +72,509 @@ func TestConfig(t *testing.T) {
 	readConfig(strings.NewReader("{}"), conf)
 
 	js := conf.String()
-	if js != `{"Listen":"","DB":"","Debug":false,"RealIPHeader":"","RemoteUserHeader":""}` {
+	if js != `{"Listen":"","DB":"","Debug":false,"RealIPHeader":"","RemoteUserHeader":"","AdminTemplate":"","AdminTemplatesByHost":null,"JSRedirect":false,"MaxLinksPerUser":0,"AdminUsers":null,"CanonicalHost":"","MaxURLLength":2048,"ReferrerPolicy":"","DefaultUser":"test","ListTimeoutSeconds":10,"InjectCredentials":false,"HitWriteMode":"","PreviewBody":false,"LogAPIBodies":false,"ApplicationName":"urlredir","IdempotentDelete":false,"ImportBatchSize":1000,"TargetHostAllow":null,"TargetHostDeny":null,"HSTSMaxAge":0,"HSTSIncludeSubDomains":false,"HSTSPreload":false,"MaxConcurrentPerIP":0,"NotFoundRedirect":"","RedirectCode":302,"PassQuery":false,"ForceOwnerFromContext":false,"GoneWhenExhausted":false,"CookieSecret":"","AllowedSchemes":null,"GeneratedNameLength":6,"GeneratedNameAlphabet":"23456789abcdefghijkmnpqrstuvwxyz","ReservedNames":["_admin","debug"],"CSRFKey":"","RateLimitRPS":0,"RateLimitBurst":0,"ReuseDeletedNames":false,"PurgeDeletedAfterDays":0,"ReadReplica":"","DBMaxOpenConns":0,"DBMaxIdleConns":0,"DBConnMaxLifetimeSeconds":0,"DBConnMaxIdleTimeSeconds":0,"TLSCert":"","TLSKey":"","TLSMinVersion":"1.2","TLSCipherSuites":null,"HTTPRedirectListen":"","TracingEndpoint":"","CORSAllowedOrigins":null,"CORSAllowedMethods":["GET","POST"],"CORSAllowedHeaders":["Authorization","Content-Type"],"BaseURL":"","QRSize":256,"QRRecoveryLevel":"M","RegenerateGraceHours":0,"ExpiryGraceSeconds":0,"HitAlertWebhook":"","HitAlertPercent":90}` {
 		t.Error("Config: ", js)
 	}
 }
 
+func TestConfigSecrets(t *testing.T) {
+	t.Parallel()
+
+	c := config{ //nolint:exhaustruct
+		CookieSecret:    "cookie-secret",
+		CSRFKey:         "csrf-key",
+		HitAlertWebhook: "https://hooks.example.com/hook-token",
+	}
+
+	for _, secret := range []string{"cookie-secret", "csrf-key",
+		"hook-token"} {
+		if js := c.String(); strings.Contains(js, secret) {
+			t.Error("Secret published:", js)
+		}
+	}
+
+	if c.CookieSecret != "cookie-secret" {
+		t.Error("Secret lost:", c.CookieSecret)
+	}
+}
+
+func TestEnvName(t *testing.T) {
+	t.Parallel()
+
+	for field, want := range map[string]string{
+		"Listen":                   "URLREDIR_LISTEN",
+		"DB":                       "URLREDIR_DB",
+		"RemoteUserHeader":         "URLREDIR_REMOTE_USER_HEADER",
+		"HSTSMaxAge":               "URLREDIR_HSTS_MAX_AGE",
+		"RateLimitRPS":             "URLREDIR_RATE_LIMIT_RPS",
+		"DBConnMaxLifetimeSeconds": "URLREDIR_DB_CONN_MAX_LIFETIME_SECONDS",
+	} {
+		if got := envName(field); got != want {
+			t.Errorf("Wrong env name for %s: got %s , want %s", field, got,
+				want)
+		}
+	}
+}
+
+//nolint:paralleltest // sets the environment
+func TestApplyEnv(t *testing.T) {
+	t.Setenv("URLREDIR_LISTEN", ":9090")
+	t.Setenv("URLREDIR_DEBUG", "yes")
+	t.Setenv("URLREDIR_ADMIN_USERS", "alice, bob")
+	t.Setenv("URLREDIR_REDIRECT_CODE", "301")
+
+	conf := &config{} //nolint:exhaustruct
+	readConfig(strings.NewReader(`{"Listen": ":8080", "DB": "dbname=x",
+"Debug": false, "AdminUsers": ["carol"]}`), conf)
+
+	// the environment takes precedence over the file
+	if conf.Listen != ":9090" || !conf.Debug ||
+		!slices.Equal(conf.AdminUsers, []string{"alice", "bob"}) ||
+		conf.RedirectCode != http.StatusMovedPermanently {
+		t.Error("Environment not applied:", conf)
+	}
+
+	// and leaves the rest alone
+	if conf.DB != "dbname=x" || conf.ImportBatchSize != defaultImportBatchSize {
+		t.Error("Config not kept:", conf)
+	}
+
+	for _, tc := range []struct {
+		value string
+		want  bool
+	}{
+		{"true", true}, {"1", true}, {"YES", true},
+		{"false", false}, {"0", false}, {"no", false},
+	} {
+		t.Setenv("URLREDIR_DEBUG", tc.value)
+		checkErr(t, applyEnv(conf))
+
+		if conf.Debug != tc.want {
+			t.Errorf("Wrong boolean for %s: got %v", tc.value, conf.Debug)
+		}
+	}
+
+	t.Setenv("URLREDIR_DEBUG", "maybe")
+
+	if err := applyEnv(conf); !errors.Is(err, ErrInvalidBool) {
+		t.Error("Invalid boolean accepted:", err)
+	}
+
+	t.Setenv("URLREDIR_DEBUG", "no")
+	t.Setenv("URLREDIR_REDIRECT_CODE", "many")
+
+	if err := applyEnv(conf); err == nil ||
+		!strings.Contains(err.Error(), "URLREDIR_REDIRECT_CODE") {
+		t.Error("Invalid integer accepted:", err)
+	}
+}
+
+func TestConfigFormats(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	files := map[string]string{
+		"config.json": `{
+    "Listen": ":8080",
+    "Debug": true,
+    "RedirectCode": 301,
+    "AdminUsers": ["alice", "bob"],
+    "AdminTemplatesByHost": {"example.com": "example.html"}
+}`,
+		"config.yaml": `
+Listen: ":8080"
+Debug: true
+RedirectCode: 301
+AdminUsers:
+  - alice
+  - bob
+AdminTemplatesByHost:
+  example.com: example.html
+`,
+		"config.toml": `
+Listen = ":8080"
+Debug = true
+RedirectCode = 301
+AdminUsers = ["alice", "bob"]
+
+[AdminTemplatesByHost]
+"example.com" = "example.html"
+`,
+	}
+
+	want := &config{} //nolint:exhaustruct
+	readConfigFile(filepath.Join(dir, "missing.json"), want)
+	want.Listen = ":8080"
+	want.Debug = true
+	want.RedirectCode = http.StatusMovedPermanently
+	want.AdminUsers = []string{"alice", "bob"}
+	want.AdminTemplatesByHost = map[string]string{
+		"example.com": "example.html",
+	}
+
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		checkErr(t, os.WriteFile(path, []byte(content), 0o600))
+
+		got := &config{} //nolint:exhaustruct
+		readConfigFile(path, got)
+
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("Wrong config from %s: got %s , want %s", name, got,
+				want)
+		}
+	}
+
+	if _, err := configToJSON("config.ini", strings.NewReader("")); !errors.Is(
+		err, ErrConfigFormat) {
+		t.Error("Unknown format accepted:", err)
+	}
+}
+
+func TestConfigValidate(t *testing.T) {
+	t.Parallel()
+
+	valid := config{ //nolint:exhaustruct
+		Listen:                ":8080",
+		DB:                    "dbname=urlredir",
+		RealIPHeader:          "X-Real-IP",
+		RemoteUserHeader:      "X-Remote-User",
+		ImportBatchSize:       defaultImportBatchSize,
+		RedirectCode:          defaultRedirectCode,
+		GeneratedNameLength:   defaultGeneratedNameLength,
+		GeneratedNameAlphabet: defaultNameAlphabet,
+		QRSize:                defaultQRSize,
+		QRRecoveryLevel:       defaultQRRecoveryLevel,
+		TLSMinVersion:         defaultTLSMinVersion,
+	}
+
+	checkErr(t, valid.validate())
+
+	withBase := valid
+	withBase.BaseURL = "https://s.example.com/links"
+	checkErr(t, withBase.validate())
+
+	testCases := []struct {
+		name   string
+		modify func(c *config)
+		want   []string
+	}{
+		{"blank listen", func(c *config) { c.Listen = "" }, []string{"Listen"}},
+		{"no port", func(c *config) { c.Listen = "localhost" },
+			[]string{"Listen"}},
+		{"bad port", func(c *config) { c.Listen = ":99999" },
+			[]string{"invalid port"}},
+		{"blank db", func(c *config) { c.DB = " " }, []string{"DB is empty"}},
+		{"bad header", func(c *config) { c.RemoteUserHeader = "X User" },
+			[]string{"RemoteUserHeader"}},
+		{"same headers", func(c *config) { c.RealIPHeader = "x-remote-user" },
+			[]string{"both"}},
+		{"cert only", func(c *config) { c.TLSCert = "cert.pem" },
+			[]string{"TLSCert and TLSKey"}},
+		{"bad tls version", func(c *config) { c.TLSMinVersion = "1.4" },
+			[]string{"TLSMinVersion"}},
+		{"insecure cipher suite", func(c *config) {
+			c.TLSCipherSuites = []string{"TLS_RSA_WITH_RC4_128_SHA"}
+		}, []string{"TLSCipherSuites"}},
+		{"redirect without tls", func(c *config) {
+			c.HTTPRedirectListen = ":8081"
+		}, []string{"HTTPRedirectListen requires"}},
+		{"relative base", func(c *config) { c.BaseURL = "/links" },
+			[]string{"BaseURL"}},
+		{"base with query", func(c *config) {
+			c.BaseURL = "https://s.example.com/?a=b"
+		}, []string{"BaseURL"}},
+		{"bad base", func(c *config) { c.BaseURL = "https://[::1" },
+			[]string{"BaseURL"}},
+		{"negative grace", func(c *config) { c.RegenerateGraceHours = -1 },
+			[]string{"RegenerateGraceHours"}},
+		{"negative expiry grace", func(c *config) {
+			c.ExpiryGraceSeconds = -1
+		}, []string{"ExpiryGraceSeconds"}},
+		{"bad hit alert webhook", func(c *config) {
+			c.HitAlertWebhook = "hooks.example.com"
+			c.HitAlertPercent = 90
+		}, []string{"HitAlertWebhook"}},
+		{"bad hit alert percent", func(c *config) {
+			c.HitAlertWebhook = "https://hooks.example.com/x"
+			c.HitAlertPercent = 0
+		}, []string{"HitAlertPercent"}},
+		{"tiny qr", func(c *config) { c.QRSize = 8 }, []string{"QRSize"}},
+		{"bad qr level", func(c *config) { c.QRRecoveryLevel = "X" },
+			[]string{"QRRecoveryLevel"}},
+		{"bad referrer policy", func(c *config) { c.ReferrerPolicy = "some" },
+			[]string{"ReferrerPolicy"}},
+		{"bad redirect code", func(c *config) { c.RedirectCode = 200 },
+			[]string{"RedirectCode"}},
+		{"negative pool", func(c *config) { c.DBMaxOpenConns = -1 },
+			[]string{"DB pool"}},
+		{"no user", func(c *config) {
+			c.RemoteUserHeader = ""
+			c.DefaultUser = ""
+		}, []string{"DefaultUser"}},
+		{"everything", func(c *config) {
+			c.Listen = "8080"
+			c.DB = ""
+			c.RealIPHeader = "X-Real-IP:"
+			c.HitWriteMode = "sometimes"
+			c.ImportBatchSize = 0
+			c.RateLimitRPS = -1
+			c.PurgeDeletedAfterDays = -1
+			c.GeneratedNameLength = 0
+			c.GeneratedNameAlphabet = "a"
+		}, []string{
+			"Listen", "DB is empty", "RealIPHeader", "HitWriteMode",
+			"ImportBatchSize", "RateLimitRPS", "PurgeDeletedAfterDays",
+			"GeneratedNameLength", "GeneratedNameAlphabet",
+		}},
+	}
+
+	for _, tc := range testCases {
+		c := valid
+		tc.modify(&c)
+
+		err := c.validate()
+		if !errors.Is(err, ErrInvalidConfig) {
+			t.Errorf("Invalid config %s accepted: %v", tc.name, err)
+
+			continue
+		}
+
+		for _, want := range tc.want {
+			if !strings.Contains(err.Error(), want) {
+				t.Errorf("Missing %q in error for %s: %v", want, tc.name, err)
+			}
+		}
+
+		if n := strings.Count(err.Error(), string(ErrInvalidConfig)); n !=
+			len(tc.want) {
+			t.Errorf("Wrong number of problems for %s: %d", tc.name, n)
+		}
+	}
+}
+
+// writeTestCert writes a self-signed certificate for 127.0.0.1 and its key
+// into dir, returning the file names.
+func writeTestCert(t *testing.T, dir string) (string, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	checkErr(t, err)
+
+	tmpl := x509.Certificate{ //nolint:exhaustruct
+		SerialNumber: big.NewInt(1),
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, &tmpl, &tmpl,
+		&key.PublicKey, key)
+	checkErr(t, err)
+
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	checkErr(t, err)
+
+	cert := filepath.Join(dir, "cert.pem")
+	keyFile := filepath.Join(dir, "key.pem")
+
+	checkErr(t, os.WriteFile(cert, pem.EncodeToMemory(&pem.Block{
+		Type: "CERTIFICATE", Bytes: der,
+	}), 0o600))
+	checkErr(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{
+		Type: "PRIVATE KEY", Bytes: keyDER,
+	}), 0o600))
+
+	return cert, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		version    string
+		suites     []string
+		want       uint16
+		wantSuites []uint16
+	}{
+		{"1.2", nil, tls.VersionTLS12, nil},
+		{"1.3", nil, tls.VersionTLS13, nil},
+		{"1.0", []string{"TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"},
+			tls.VersionTLS10,
+			[]uint16{tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256}},
+	}
+
+	for _, tc := range testCases {
+		//nolint:exhaustruct
+		got := tlsConfig(&config{
+			TLSMinVersion: tc.version, TLSCipherSuites: tc.suites,
+		})
+
+		if got.MinVersion != tc.want {
+			t.Errorf("Wrong min version for %s: got %x , want %x", tc.version,
+				got.MinVersion, tc.want)
+		}
+
+		if !slices.Equal(got.CipherSuites, tc.wantSuites) {
+			t.Errorf("Wrong cipher suites for %v: got %v , want %v",
+				tc.suites, got.CipherSuites, tc.wantSuites)
+		}
+	}
+}
+
+func TestServe(t *testing.T) {
+	t.Parallel()
+
+	cert, key := writeTestCert(t, t.TempDir())
+
+	testCases := []struct {
+		name   string
+		c      config
+		scheme string
+	}{
+		{"plain", config{}, "http"}, //nolint:exhaustruct
+		{"tls", config{TLSCert: cert, TLSKey: key}, //nolint:exhaustruct
+			"https"},
+	}
+
+	for _, tc := range testCases {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		checkErr(t, err)
+
+		srv := &http.Server{ //nolint:exhaustruct
+			Handler: http.HandlerFunc(func(http.ResponseWriter,
+				*http.Request) {
+			}),
+			ReadHeaderTimeout: time.Second,
+		}
+
+		go func() { _ = serve(srv, ln, &tc.c) }()
+
+		client := &http.Client{ //nolint:exhaustruct
+			Transport: &http.Transport{ //nolint:exhaustruct
+				TLSClientConfig: &tls.Config{ //nolint:exhaustruct
+					InsecureSkipVerify: true, //nolint:gosec
+				},
+			},
+		}
+
+		resp, err := client.Get(tc.scheme + "://" + ln.Addr().String() +
+			"/") //nolint:noctx
+		checkErr(t, err)
+		checkErr(t, resp.Body.Close())
+
+		if (resp.TLS != nil) != useTLS(&tc.c) {
+			t.Errorf("Wrong mode for %s: TLS %v", tc.name, resp.TLS != nil)
+		}
+
+		checkErr(t, srv.Close())
+	}
+}
+
+func TestHTTPSRedirectHandler(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		listen, target, want string
+	}{
+		{":443", "http://example.com/foo?bar=1",
+			"https://example.com/foo?bar=1"},
+		{":8443", "http://example.com:8080/foo",
+			"https://example.com:8443/foo"},
+		{"127.0.0.1:https", "http://example.com/", "https://example.com/"},
+	}
+
+	for _, tc := range testCases {
+		w := httptest.NewRecorder()
+		r := httptest.NewRequest(http.MethodGet, tc.target, nil)
+
+		httpsRedirectHandler(tc.listen).ServeHTTP(w, r)
+
+		if w.Code != http.StatusMovedPermanently {
+			t.Errorf("Wrong status for %s: %d", tc.target, w.Code)
+		}
+
+		if got := w.Header().Get("Location"); got != tc.want {
+			t.Errorf("Wrong redirect for %s on %s: got %s , want %s",
+				tc.target, tc.listen, got, tc.want)
+		}
+	}
+}
+
+//nolint:paralleltest // replaces the live config
+func TestReloadConfig(t *testing.T) {
+	t.Cleanup(func() {
+		liveConfig.Store(nil)
+		setLogLevel(false)
+	})
+
+	name := filepath.Join(t.TempDir(), "config.json")
+	write := func(debug bool, header, listen string) {
+		t.Helper()
+
+		b, err := json.Marshal(map[string]any{
+			"Listen": listen, "DB": "dbname=urlredir", "Debug": debug,
+			"RemoteUserHeader": header,
+		})
+		checkErr(t, err)
+		checkErr(t, os.WriteFile(name, b, 0o600))
+	}
+
+	handler := chain{reloadable(userMiddleware)}.apply(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.WriteString(w, must(getUser(r.Context())))
+		}))
+	user := func(header string) string {
+		t.Helper()
+
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set(header, "alice")
+		rr := httptest.NewRecorder()
+		handler.ServeHTTP(rr, req)
+
+		return rr.Body.String()
+	}
+
+	write(true, "X-User", "127.0.0.1:1")
+	checkErr(t, reloadConfig(name))
+
+	if logLevel.Level() != slog.LevelDebug {
+		t.Error("Debug not enabled:", logLevel.Level())
+	}
+
+	if got := user("X-User"); got != "alice" {
+		t.Error("Wrong user after reload:", got)
+	}
+
+	// Listen can't change without a restart
+	if liveConf().Listen != conf.Listen {
+		t.Error("Listen reloaded:", liveConf().Listen)
+	}
+
+	write(false, "X-Other", "127.0.0.1:1")
+	checkErr(t, reloadConfig(name))
+
+	if logLevel.Level() != slog.LevelInfo {
+		t.Error("Debug not disabled:", logLevel.Level())
+	}
+
+	if got := user("X-Other"); got != "alice" {
+		t.Error("Wrong user after second reload:", got)
+	}
+
+	// invalid files are rejected as a whole
+	write(true, "X-User", "")
+
+	if err := reloadConfig(name); !errors.Is(err, ErrInvalidConfig) {
+		t.Error("Invalid config reloaded:", err)
+	}
+
+	if logLevel.Level() != slog.LevelInfo ||
+		liveConf().RemoteUserHeader != "X-Other" {
+		t.Error("Invalid config applied")
+	}
+}
+
 func TestConfigFromFile(t *testing.T) {
 	t.Parallel()
 
@@ -75,7 +593,7 @@ func TestSetupServeMux(t *testing.T) {
 	db, err := newPostgresDB()
 	checkErr(t, err)
 
-	mux, ok := setupServeMux(db).(*http.ServeMux)
+	mux, ok := setupServeMux(db, nil).(*http.ServeMux)
 	if !ok {
 		t.Fatal("failed type assertion")
 	}
@@ -93,4 +611,81 @@ func TestSetupServeMux(t *testing.T) {
 	if pattern != "GET /_admin" {
 		t.Error("Wrong pattern:", pattern)
 	}
+
+	_, pattern = mux.Handler(httptest.NewRequest(http.MethodGet,
+		"/_api/urls/foo/hits.csv", nil))
+
+	if pattern != "GET /_api/urls/{name}/hits.csv" {
+		t.Error("Wrong pattern:", pattern)
+	}
+
+	// the mux lists the methods routed for names
+	rr, _ := testRequest(t, mux, httptest.NewRequest(http.MethodPatch, "/foo",
+		nil), http.StatusMethodNotAllowed)
+
+	if got, want := rr.Header().Get("Allow"),
+		"DELETE, GET, HEAD, POST, PUT"; got != want {
+		t.Errorf("Wrong allow header: got %s , want %s", got, want)
+	}
+
+	// malformed forms are rejected before the CSRF token is checked
+	req := httptest.NewRequest(http.MethodPost, "/_admin",
+		strings.NewReader("name=%zz"))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	if conf.RemoteUserHeader != "" {
+		req.Header.Set(conf.RemoteUserHeader, "test")
+	}
+
+	if _, body := testRequest(t, mux, req,
+		http.StatusBadRequest); body != string(ErrMalformedForm) {
+		t.Errorf("Wrong body: got %s , want %s", body, ErrMalformedForm)
+	}
+
+	// names shadowed by routes can't be created
+	for _, name := range []string{"_admin", "version"} {
+		if !slices.Contains(conf.routeNames, name) {
+			t.Error("Missing route name:", name)
+		}
+	}
+
+	for _, name := range conf.routeNames {
+		req := newAdminForm(name, cExampleCom, "test")
+		if _, _, _, err := validateAdminForm(req, &conf); !errors.Is(err,
+			ErrReservedName) {
+			t.Errorf("Route name %s not rejected: %v", name, err)
+		}
+	}
+}
+
+//nolint:paralleltest // replaces the default logger
+func TestLogFeatures(t *testing.T) {
+	logs := captureLogs(t)
+
+	logFeatures(&config{ //nolint:exhaustruct
+		JSRedirect:     true,
+		ReferrerPolicy: referrerNone,
+		LogAPIBodies:   true,
+	})
+
+	for _, attr := range []string{
+		"jsRedirect=true", "referrers=false", "logAPIBodies=false",
+		"debug=false",
+	} {
+		if !strings.Contains(logs.String(), attr) {
+			t.Errorf("Missing %s in %s", attr, logs.String())
+		}
+	}
+}
+
+func TestHSTSValue(t *testing.T) {
+	t.Parallel()
+
+	if got, want := hstsValue(&config{ //nolint:exhaustruct
+		HSTSMaxAge:            31536000,
+		HSTSIncludeSubDomains: true,
+		HSTSPreload:           true,
+	}), "max-age=31536000; includeSubDomains; preload"; got != want {
+		t.Errorf("Wrong HSTS value: got %s , want %s", got, want)
+	}
 }
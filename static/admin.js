@@ -0,0 +1,53 @@
+// Copyright © Paul Tötterman <paul.totterman@gmail.com>. All rights reserved.
+
+'use strict';
+
+function csrfToken() {
+	var meta = document.querySelector('meta[name="csrf-token"]');
+	return meta ? meta.content : '';
+}
+
+function reloadOrAlert(resp) {
+	if (resp.ok) {
+		window.location.href = '/_admin';
+		return;
+	}
+	resp.text().then(function(text) {
+		window.alert(text);
+	});
+}
+
+function deleteLink(name) {
+	fetch('/' + name, {
+		method: 'DELETE',
+		headers: {'X-CSRF-Token': csrfToken()},
+	}).then(reloadOrAlert);
+}
+
+function editLink(name, url) {
+	url = window.prompt('URL for ' + name, url);
+	if (!url) {
+		return;
+	}
+	fetch('/' + name, {
+		method: 'PUT',
+		headers: {'Content-Type': 'application/x-www-form-urlencoded'},
+		body: 'url=' + encodeURIComponent(url),
+	}).then(reloadOrAlert);
+}
+
+document.addEventListener('click', function(event) {
+	var link = event.target.closest('a[data-action]');
+	if (!link) {
+		return;
+	}
+	event.preventDefault();
+	switch (link.dataset.action) {
+	case 'delete':
+		deleteLink(link.dataset.name);
+		break;
+	case 'edit':
+		editLink(link.dataset.name, link.dataset.url);
+		break;
+	}
+});
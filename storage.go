@@ -3,20 +3,36 @@
 package main
 
 import (
+	"cmp"
 	"context"
 	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"iter"
+	"log/slog"
 	"net"
-	"strconv"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
 )
 
-type execer interface {
-	ExecContext(ctx context.Context, query string, args ...any) (
-		sql.Result, error)
+// migration is a schema change, applied once in version order. The steps from
+// before migrations were tracked are idempotent, so that existing databases
+// are adopted as is.
+type migration struct {
+	version int
+	up      string
 }
 
-func ensureSchema(e execer) error {
-	const q = `
+// migrations are the schema changes so far. Never change an applied step,
+// append a new one instead.
+//
+//nolint:gochecknoglobals
+var migrations = []migration{
+	{1, `
 CREATE TABLE IF NOT EXISTS urls (
     created timestamp with time zone NOT NULL DEFAULT now(),
     id bigint GENERATED BY DEFAULT AS IDENTITY PRIMARY KEY,
@@ -33,24 +49,218 @@ CREATE TABLE IF NOT EXISTS hits (
     referrer text,
     agent text
 );
+`},
+	{2, `
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS fragment text NOT NULL DEFAULT '';
+`},
+	{3, `
+CREATE TABLE IF NOT EXISTS quotas (
+    "user" text PRIMARY KEY,
+    max_links integer NOT NULL
+);
+`},
+	{4, `
+CREATE TABLE IF NOT EXISTS acl (
+    url_id bigint NOT NULL REFERENCES urls (id) ON DELETE CASCADE,
+    "user" text NOT NULL,
+    PRIMARY KEY (url_id, "user")
+);
+`},
+	{5, `
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS userinfo text NOT NULL DEFAULT '';
+`},
+	{6, `
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS headers jsonb NOT NULL DEFAULT '{}';
+`},
+	{7, `
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS code integer;
+`},
+	{8, `
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS expires_at timestamp with time zone;
+`},
+	{9, `
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS max_hits bigint;
+`},
+	{10, `
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS password_hash text;
+`},
+	{11, `
+CREATE TABLE IF NOT EXISTS api_tokens (
+    hash text PRIMARY KEY,
+    "user" text NOT NULL,
+    created timestamp with time zone NOT NULL DEFAULT now(),
+    last_used timestamp with time zone
+);
+`},
+	{12, `
+CREATE TABLE IF NOT EXISTS audit (
+    created timestamp with time zone NOT NULL DEFAULT now(),
+    "user" text NOT NULL,
+    action text NOT NULL,
+    name text NOT NULL,
+    remotehost inet
+);
+`},
+	{13, `
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS deleted_at timestamp with time zone;
+`},
+	{14, `
+CREATE TABLE IF NOT EXISTS blocked_targets (
+    target text PRIMARY KEY,
+    "user" text NOT NULL,
+    created timestamp with time zone NOT NULL DEFAULT now()
+);
+`},
+	{15, `
+CREATE TABLE IF NOT EXISTS aliases (
+    name text PRIMARY KEY,
+    url_id bigint NOT NULL REFERENCES urls (id) ON DELETE CASCADE,
+    expires_at timestamp with time zone NOT NULL
+);
+`},
+	{16, `
+ALTER TABLE urls ADD COLUMN IF NOT EXISTS hit_alert_at timestamp with time zone;
+`},
+}
+
+// ensureSchema brings the schema up to date with migrations.
+func ensureSchema(db beginner) error {
+	return migrate(context.Background(), db, migrations)
+}
+
+// migrate applies the steps newer than the schema version, all in one
+// transaction so that a failing step leaves the schema as it was.
+func migrate(ctx context.Context, db beginner, steps []migration) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed beginning tx: %w", err)
+	}
+
+	if err := applyMigrations(ctx, tx, steps); err != nil {
+		if rerr := tx.Rollback(); rerr != nil {
+			return fmt.Errorf("%w: %w: %w", ErrFailedRollback, rerr, err)
+		}
+
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed committing tx: %w", err)
+	}
+
+	return nil
+}
+
+// applyMigrations applies the steps newer than the version recorded in
+// schema_migrations. Concurrent runs wait for each other.
+func applyMigrations(ctx context.Context, tx *sql.Tx, steps []migration) error {
+	const q = `
+CREATE TABLE IF NOT EXISTS schema_migrations (
+    version integer PRIMARY KEY,
+    applied timestamp with time zone NOT NULL DEFAULT now()
+);
+
+LOCK TABLE schema_migrations IN EXCLUSIVE MODE;
 `
 
-	ctx := context.Background()
+	if _, err := tx.ExecContext(ctx, q); err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	version, err := schemaVersion(ctx, tx)
+	if err != nil {
+		return err
+	}
+
+	for _, step := range steps {
+		if step.version <= version {
+			continue
+		}
+
+		if _, err := tx.ExecContext(ctx, step.up); err != nil {
+			return fmt.Errorf("failed migrating to version %d: %w",
+				step.version, err)
+		}
+
+		if err := addMigration(ctx, tx, step.version); err != nil {
+			return err
+		}
+
+		slog.InfoContext(ctx, "MIGRATE", slog.Int("version", step.version))
+	}
+
+	return nil
+}
 
-	if _, err := e.ExecContext(ctx, q); err != nil {
+// addMigration records the migration to version as applied.
+func addMigration(ctx context.Context, tx *sql.Tx, version int) error {
+	const q = `
+INSERT INTO schema_migrations (version)
+    VALUES ($1);
+`
+
+	if _, err := tx.ExecContext(ctx, q, version); err != nil {
 		return fmt.Errorf("failed querying DB: %w", err)
 	}
 
 	return nil
 }
 
+// schemaVersion returns the version of the latest applied migration, 0 for
+// none.
+func schemaVersion(ctx context.Context, tx *sql.Tx) (int, error) {
+	const q = `
+SELECT
+    COALESCE(max(version), 0)
+FROM
+    schema_migrations;
+`
+
+	var version int
+
+	if err := tx.QueryRowContext(ctx, q).Scan(&version); err != nil {
+		return 0, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return version, nil
+}
+
+// withApplicationName adds application_name to the connection string dsn,
+// unless it already has one.
+func withApplicationName(dsn, name string) (string, error) {
+	if strings.HasPrefix(dsn, "postgres://") ||
+		strings.HasPrefix(dsn, "postgresql://") {
+		var err error
+
+		dsn, err = pq.ParseURL(dsn)
+		if err != nil {
+			return "", fmt.Errorf("failed parsing DB URL: %w", err)
+		}
+	}
+
+	if name == "" || strings.Contains(dsn, "application_name=") {
+		return dsn, nil
+	}
+
+	name = strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(name)
+
+	return strings.TrimSpace(dsn + " application_name='" + name + "'"), nil
+}
+
 // newPostgresDB returns an initialized postgresDB.
 func newPostgresDB() (*sql.DB, error) {
-	db, err := sql.Open("postgres", conf.DB)
+	dsn, err := withApplicationName(conf.DB, conf.ApplicationName)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("postgres", dsn)
 	if err != nil {
 		return nil, fmt.Errorf("failed opening DB: %w", err)
 	}
 
+	tunePool(db, &conf)
+
 	if err := ensureSchema(db); err != nil {
 		return nil, fmt.Errorf("failed ensuring schema: %w", err)
 	}
@@ -58,33 +268,276 @@ func newPostgresDB() (*sql.DB, error) {
 	return db, nil
 }
 
-// getURLnID returns URL and its ID.
-func getURLnID(ctx context.Context, tx *sql.Tx, name string) (string, int64,
-	error,
-) {
-	const q = `
+// poolTuner is the part of *sql.DB configured by tunePool.
+type poolTuner interface {
+	SetMaxOpenConns(n int)
+	SetMaxIdleConns(n int)
+	SetConnMaxLifetime(d time.Duration)
+	SetConnMaxIdleTime(d time.Duration)
+}
+
+// tunePool applies the pool settings of c to db. Unset ones keep the driver
+// defaults.
+func tunePool(db poolTuner, c *config) {
+	if c.DBMaxOpenConns > 0 {
+		db.SetMaxOpenConns(c.DBMaxOpenConns)
+	}
+
+	if c.DBMaxIdleConns > 0 {
+		db.SetMaxIdleConns(c.DBMaxIdleConns)
+	}
+
+	if c.DBConnMaxLifetimeSeconds > 0 {
+		db.SetConnMaxLifetime(time.Duration(c.DBConnMaxLifetimeSeconds) *
+			time.Second)
+	}
+
+	if c.DBConnMaxIdleTimeSeconds > 0 {
+		db.SetConnMaxIdleTime(time.Duration(c.DBConnMaxIdleTimeSeconds) *
+			time.Second)
+	}
+}
+
+// newReplicaDB returns a pool for the read replica at dsn. Its schema follows
+// the primary, so it isn't migrated.
+func newReplicaDB(dsn string) (*sql.DB, error) {
+	dsn, err := withApplicationName(dsn, conf.ApplicationName)
+	if err != nil {
+		return nil, err
+	}
+
+	db, err := sql.Open("postgres", dsn)
+	if err != nil {
+		return nil, fmt.Errorf("failed opening DB: %w", err)
+	}
+
+	tunePool(db, &conf)
+
+	return db, nil
+}
+
+// Queries run for every redirect, prepared once by prepareStatements.
+const (
+	getRedirectQuery = `
 UPDATE
     urls
 SET
     hits = hits + 1
 WHERE
     name = $1
+    AND deleted_at IS NULL
+    AND (expires_at IS NULL
+        OR expires_at + make_interval(secs => $2) > now())
+    AND (max_hits IS NULL
+        OR hits < max_hits)
 RETURNING
     id,
-    url;
+    url,
+    fragment,
+    userinfo,
+    headers,
+    COALESCE(code, 0),
+    COALESCE(password_hash, ''),
+    COALESCE(expires_at <= now(), FALSE);
+`
+	getIDnUserQuery = `
+SELECT
+    id,
+    "user"
+FROM
+    urls
+WHERE
+    name = $1
+    AND deleted_at IS NULL;
+`
+	addHitQuery = `
+INSERT INTO hits (
+    url_id,
+    remotehost,
+    agent,
+    referrer)
+VALUES (
+    $1,
+    $2,
+    $3,
+    $4);
 `
+)
+
+// statements are the prepared hot queries of pool by query, see
+// prepareStatements. Written once before serving, so read without locking.
+//
+//nolint:gochecknoglobals
+var statements map[string]*sql.Stmt
+
+// prepareStatements prepares the hot queries on db, which must be pool, as
+// the statements are only usable in its transactions. Each statement is
+// prepared on a connection the first time it is used there.
+func prepareStatements(ctx context.Context, db *sql.DB) error {
+	prepared := make(map[string]*sql.Stmt)
+
+	for _, q := range []string{
+		getRedirectQuery, getIDnUserQuery, addHitQuery,
+	} {
+		stmt, err := db.PrepareContext(ctx, q)
+		if err != nil {
+			closeStatements(prepared)
+
+			return fmt.Errorf("failed preparing statement: %w", err)
+		}
+
+		prepared[q] = stmt
+	}
+
+	statements = prepared
+
+	return nil
+}
+
+// closeStatements closes the prepared statements, logging any errors.
+func closeStatements(stmts map[string]*sql.Stmt) {
+	for _, stmt := range stmts {
+		if err := stmt.Close(); err != nil {
+			slog.Error("failed closing statement", slog.Any("err", err))
+		}
+	}
+}
+
+// prepared returns the prepared statement of q, if there is one usable in the
+// transaction of ctx. Read-only transactions may be on the replica, where the
+// statements aren't prepared.
+func prepared(ctx context.Context, q string) (*sql.Stmt, bool) {
+	if ctx.Value(readOnlyKey) != nil {
+		return nil, false
+	}
+
+	stmt, ok := statements[q]
+
+	return stmt, ok
+}
+
+// queryRow runs q in tx, using its prepared statement if there is one.
+func queryRow(ctx context.Context, tx *sql.Tx, q string,
+	args ...any,
+) *sql.Row {
+	if stmt, ok := prepared(ctx, q); ok {
+		return tx.StmtContext(ctx, stmt).QueryRowContext(ctx, args...)
+	}
+
+	return tx.QueryRowContext(ctx, q, args...)
+}
+
+// exec runs q in tx, using its prepared statement if there is one. Errors are
+// returned as is, for the caller to wrap.
+func exec(ctx context.Context, tx *sql.Tx, q string, args ...any) (sql.Result,
+	error,
+) {
+	if stmt, ok := prepared(ctx, q); ok {
+		//nolint:wrapcheck
+		return tx.StmtContext(ctx, stmt).ExecContext(ctx, args...)
+	}
+
+	return tx.ExecContext(ctx, q, args...) //nolint:wrapcheck
+}
+
+// urlOptions are the optional settings of a URL.
+type urlOptions struct {
+	// Fragment is appended to the URL when redirecting, empty for none
+	Fragment string
+	// Userinfo is injected to the URL when redirecting, empty for none
+	Userinfo string
+	// Headers are added to the redirect response
+	Headers map[string]string
+	// Code is the redirect status, 0 for the configured default
+	Code int
+	// ExpiresAt is when the URL stops working, nil for never
+	ExpiresAt *time.Time
+	// MaxHits is the number of hits after which the URL stops working, 0
+	// for unlimited
+	MaxHits int64
+	// PasswordHash is the bcrypt hash of the password needed to follow
+	// the URL, empty for none
+	PasswordHash string
+}
+
+// redirect is what is needed to redirect a client to a stored URL.
+type redirect struct {
+	ID  int64
+	URL string
+	urlOptions
+	// Expired tells that the URL is only redirecting for the grace period
+	// past its expiry
+	Expired bool
+}
+
+// getRedirect counts a hit and returns the redirect for the named URL. Expired
+// and deleted URLs and URLs out of hits are treated as missing, expired ones
+// only once grace has passed since expiry. Expiry is judged by the clock of
+// the DB, so that servers with drifting clocks agree.
+func getRedirect(ctx context.Context, tx *sql.Tx, name string,
+	grace time.Duration,
+) (redirect, error) {
+	ctx, span := startSpan(ctx, "getRedirect")
+	defer span.End()
 
 	var (
-		id  int64
-		url string
+		rd      redirect
+		headers []byte
 	)
 
 	//nolint:execinquery
-	if err := tx.QueryRowContext(ctx, q, name).Scan(&id, &url); err != nil {
-		return "", 0, fmt.Errorf("failed querying DB: %w", err)
+	if err := queryRow(ctx, tx, getRedirectQuery, name,
+		grace.Seconds()).Scan(&rd.ID, &rd.URL, &rd.Fragment, &rd.Userinfo,
+		&headers, &rd.Code, &rd.PasswordHash, &rd.Expired); err != nil {
+		return redirect{}, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	if err := json.Unmarshal(headers, &rd.Headers); err != nil {
+		return redirect{}, fmt.Errorf("failed decoding headers: %w", err)
 	}
 
-	return url, id, nil
+	return rd, nil
+}
+
+// exhaustedURL tells whether one of the named URLs is out of hits.
+func exhaustedURL(ctx context.Context, tx *sql.Tx, names []string) (bool,
+	error,
+) {
+	ctx, span := startSpan(ctx, "exhaustedURL")
+	defer span.End()
+
+	const q = `
+SELECT
+    EXISTS (
+        SELECT
+        FROM
+            urls
+        WHERE
+            name = ANY ($1)
+            AND deleted_at IS NULL
+            AND hits >= max_hits);
+`
+
+	var exhausted bool
+
+	if err := tx.QueryRowContext(ctx, q, pq.Array(names)).Scan(
+		&exhausted); err != nil {
+		return false, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return exhausted, nil
+}
+
+// getURLnID returns URL and its ID.
+func getURLnID(ctx context.Context, tx *sql.Tx, name string) (string, int64,
+	error,
+) {
+	rd, err := getRedirect(ctx, tx, name, 0)
+	if err != nil {
+		return "", 0, err
+	}
+
+	return rd.URL, rd.ID, nil
 }
 
 // getIDnUser returns the URL's ID and user.
@@ -93,22 +546,15 @@ RETURNING
 func getIDnUser(ctx context.Context, tx *sql.Tx, name string) (int64, string,
 	error,
 ) {
-	const q = `
-SELECT
-    id,
-    "user"
-FROM
-    urls
-WHERE
-    name = $1;
-`
+	ctx, span := startSpan(ctx, "getIDnUser")
+	defer span.End()
 
 	var (
 		id   int64
 		user string
 	)
 
-	if err := tx.QueryRowContext(ctx, q, name).Scan(&id,
+	if err := queryRow(ctx, tx, getIDnUserQuery, name).Scan(&id,
 		&user); err != nil {
 		return 0, "", fmt.Errorf("failed querying DB: %w", err)
 	}
@@ -116,115 +562,1948 @@ WHERE
 	return id, user, nil
 }
 
-// removeURL removes the URL speficied.
-func removeURL(ctx context.Context, tx *sql.Tx, name string) error {
-	const q = `
-DELETE FROM urls
-WHERE name = $1;
-`
+// URL is a stored URL as listed to users.
+type URL struct {
+	ID        int64      `json:"-"`
+	Name      string     `json:"name"`
+	URL       string     `json:"url"`
+	User      string     `json:"user"`
+	Hits      int64      `json:"hits"`
+	Created   time.Time  `json:"created"`
+	ExpiresAt *time.Time `json:"expires,omitempty"`
+	Expired   bool       `json:"expired,omitempty"`
+	MaxHits   int64      `json:"max_hits,omitempty"`
+	Protected bool       `json:"protected,omitempty"`
+	Visitors  int64      `json:"visitors"`
+}
 
-	if _, err := tx.ExecContext(ctx, q, name); err != nil {
-		return fmt.Errorf("failed querying DB: %w", err)
+// Expires returns the expiry time in UTC for templates, empty for never.
+func (u URL) Expires() string {
+	if u.ExpiresAt == nil {
+		return ""
 	}
 
-	return nil
+	return u.ExpiresAt.UTC().Format(time.RFC3339)
 }
 
-// addHit adds a hit to the specific URL.
-func addHit(ctx context.Context, tx *sql.Tx, urlID int64, ip net.IP,
-	agent string, referrer *string,
-) error {
+// getURLMeta returns the named URL without counting a hit. Only the fields up
+// to Created are set.
+func getURLMeta(ctx context.Context, tx *sql.Tx, name string) (URL, error) {
+	ctx, span := startSpan(ctx, "getURLMeta")
+	defer span.End()
+
 	const q = `
-INSERT INTO hits (
-    url_id,
-    remotehost,
-    agent,
-    referrer)
-VALUES (
-    $1,
-    $2,
-    $3,
-    $4);
+SELECT
+    id,
+    name,
+    url,
+    "user",
+    hits,
+    created
+FROM
+    urls
+WHERE
+    name = $1
+    AND deleted_at IS NULL;
 `
 
-	if _, err := tx.ExecContext(ctx, q, urlID, ip.String(), agent,
-		referrer); err != nil {
-		return fmt.Errorf("failed querying DB: %w", err)
+	var m URL
+
+	if err := tx.QueryRowContext(ctx, q, name).Scan(&m.ID, &m.Name, &m.URL,
+		&m.User, &m.Hits, &m.Created); err != nil {
+		return URL{}, fmt.Errorf("failed querying DB: %w", err)
 	}
 
-	return nil
+	return m, nil
 }
 
-// addURL adds a new URL to the database.
-func addURL(ctx context.Context, tx *sql.Tx, name, url, user string) error {
+// removeURL removes the URL speficied. The URL is only marked deleted, keeping
+// its hits and name, until purged by purgeDeleted.
+func removeURL(ctx context.Context, tx *sql.Tx, name string) error {
+	ctx, span := startSpan(ctx, "removeURL")
+	defer span.End()
+
 	const q = `
-INSERT INTO urls (
-    name,
-    url,
-    "user")
-VALUES (
-    $1,
-    $2,
-    $3);
+UPDATE
+    urls
+SET
+    deleted_at = now()
+WHERE
+    name = $1
+    AND deleted_at IS NULL;
 `
 
-	if _, err := tx.ExecContext(ctx, q, name, url, user); err != nil {
+	if _, err := tx.ExecContext(ctx, q, name); err != nil {
 		return fmt.Errorf("failed querying DB: %w", err)
 	}
 
 	return nil
 }
 
-// urlsForUser returns all URLs for the given user.
-func urlsForUser(ctx context.Context, tx *sql.Tx, user string) (
-	[]map[string]string, error,
-) {
+// undeleteURL restores the named URL removed by removeURL. If there is none,
+// sql.ErrNoRows is returned.
+func undeleteURL(ctx context.Context, tx *sql.Tx, name string) error {
+	ctx, span := startSpan(ctx, "undeleteURL")
+	defer span.End()
+
 	const q = `
-SELECT
-    name,
-    url,
-    hits
-FROM
+UPDATE
     urls
+SET
+    deleted_at = NULL
 WHERE
-    "user" = $1;
+    name = $1
+    AND deleted_at IS NOT NULL;
 `
 
-	//nolint:sqlclosecheck
-	rows, err := tx.QueryContext(ctx, q, user)
+	res, err := tx.ExecContext(ctx, q, name)
 	if err != nil {
-		return nil, fmt.Errorf("failed querying DB: %w", err)
+		return fmt.Errorf("failed querying DB: %w", err)
 	}
 
-	defer func(rows *sql.Rows) {
-		if err = rows.Close(); err != nil {
-			panic(err)
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	if n == 0 {
+		return fmt.Errorf("failed undeleting %s: %w", name, sql.ErrNoRows)
+	}
+
+	return nil
+}
+
+// purgeDeleted permanently removes the URLs deleted before the given time,
+// along with their hits, returning their number.
+func purgeDeleted(ctx context.Context, tx *sql.Tx, before time.Time) (int64,
+	error,
+) {
+	ctx, span := startSpan(ctx, "purgeDeleted")
+	defer span.End()
+
+	const q = `
+DELETE FROM urls
+WHERE deleted_at < $1;
+`
+
+	res, err := tx.ExecContext(ctx, q, before)
+	if err != nil {
+		return 0, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return n, nil
+}
+
+// purgeDeletedName permanently removes the named URL if it is deleted, so that
+// the name can be reused.
+func purgeDeletedName(ctx context.Context, tx *sql.Tx, name string) error {
+	ctx, span := startSpan(ctx, "purgeDeletedName")
+	defer span.End()
+
+	const q = `
+DELETE FROM urls
+WHERE name = $1
+    AND deleted_at IS NOT NULL;
+`
+
+	if _, err := tx.ExecContext(ctx, q, name); err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return nil
+}
+
+// nameInUse tells whether the name is used by a URL, counting deleted URLs
+// too if deleted is true.
+func nameInUse(ctx context.Context, tx *sql.Tx, name string,
+	deleted bool,
+) (bool, error) {
+	ctx, span := startSpan(ctx, "nameInUse")
+	defer span.End()
+
+	const q = `
+SELECT
+    EXISTS (
+        SELECT
+        FROM
+            urls
+        WHERE
+            name = $1
+            AND (deleted_at IS NULL
+                OR $2));
+`
+
+	var used bool
+
+	if err := tx.QueryRowContext(ctx, q, name, deleted).Scan(
+		&used); err != nil {
+		return false, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return used, nil
+}
+
+// updateURL points the named URL to url, keeping its hits and creation time,
+// if user owns the URL or is on its access control list. Otherwise
+// sql.ErrNoRows is returned. Blocked targets return a wrapped
+// ErrTargetBlocked.
+func updateURL(ctx context.Context, tx *sql.Tx, name, url, user string) error {
+	ctx, span := startSpan(ctx, "updateURL")
+	defer span.End()
+
+	const q = `
+UPDATE
+    urls
+SET
+    url = $2
+WHERE
+    name = $1
+    AND deleted_at IS NULL
+    AND ("user" = $3
+        OR EXISTS (
+            SELECT
+            FROM
+                acl
+            WHERE
+                acl.url_id = urls.id
+                AND acl."user" = $3));
+`
+
+	blocked, err := blockedTarget(ctx, tx, url)
+	if err != nil {
+		return err
+	}
+
+	if blocked {
+		return fmt.Errorf("%w: %s", ErrTargetBlocked, url)
+	}
+
+	res, err := tx.ExecContext(ctx, q, name, url, user)
+	if err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	if n == 0 {
+		return fmt.Errorf("failed updating %s: %w", name, sql.ErrNoRows)
+	}
+
+	return nil
+}
+
+// renameURL changes the name of the URL.
+func renameURL(ctx context.Context, tx *sql.Tx, urlID int64,
+	name string,
+) error {
+	ctx, span := startSpan(ctx, "renameURL")
+	defer span.End()
+
+	const q = `
+UPDATE
+    urls
+SET
+    name = $2
+WHERE
+    id = $1;
+`
+
+	if _, err := tx.ExecContext(ctx, q, urlID, name); err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return nil
+}
+
+// addAlias makes name an alias of the URL with the given ID until expiresAt,
+// replacing any earlier alias called name.
+func addAlias(ctx context.Context, tx *sql.Tx, name string, urlID int64,
+	expiresAt time.Time,
+) error {
+	ctx, span := startSpan(ctx, "addAlias")
+	defer span.End()
+
+	const q = `
+INSERT INTO aliases (name, url_id, expires_at)
+    VALUES ($1, $2, $3)
+ON CONFLICT (name)
+    DO UPDATE SET
+        url_id = EXCLUDED.url_id, expires_at = EXCLUDED.expires_at;
+`
+
+	if _, err := tx.ExecContext(ctx, q, name, urlID, expiresAt); err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return nil
+}
+
+// aliasedName returns the current name of the URL name is an alias of at the
+// time at. Expired aliases return a wrapped sql.ErrNoRows.
+func aliasedName(ctx context.Context, tx *sql.Tx, name string,
+	at time.Time,
+) (string, error) {
+	ctx, span := startSpan(ctx, "aliasedName")
+	defer span.End()
+
+	const q = `
+SELECT
+    urls.name
+FROM
+    aliases
+    JOIN urls ON urls.id = aliases.url_id
+WHERE
+    aliases.name = $1
+    AND aliases.expires_at > $2
+    AND urls.deleted_at IS NULL;
+`
+
+	var current string
+
+	if err := tx.QueryRowContext(ctx, q, name, at).Scan(&current); err != nil {
+		return "", fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return current, nil
+}
+
+// isUniqueViolation tells whether err is caused by a duplicate key, e.g. name.
+func isUniqueViolation(err error) bool {
+	var perr *pq.Error
+
+	return errors.As(err, &perr) && perr.Code == "23505"
+}
+
+// inACL tells whether the user is on the access control list of the URL.
+func inACL(ctx context.Context, tx *sql.Tx, urlID int64, user string) (bool,
+	error,
+) {
+	ctx, span := startSpan(ctx, "inACL")
+	defer span.End()
+
+	const q = `
+SELECT
+    EXISTS (
+        SELECT
+        FROM
+            acl
+        WHERE
+            url_id = $1
+            AND "user" = $2);
+`
+
+	var member bool
+
+	if err := tx.QueryRowContext(ctx, q, urlID, user).Scan(
+		&member); err != nil {
+		return false, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return member, nil
+}
+
+// addACL adds the user to the access control list of the URL.
+func addACL(ctx context.Context, tx *sql.Tx, urlID int64, user string) error {
+	ctx, span := startSpan(ctx, "addACL")
+	defer span.End()
+
+	const q = `
+INSERT INTO acl (
+    url_id,
+    "user")
+VALUES (
+    $1,
+    $2)
+ON CONFLICT
+    DO NOTHING;
+`
+
+	if _, err := tx.ExecContext(ctx, q, urlID, user); err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return nil
+}
+
+// removeACL removes the user from the access control list of the URL.
+func removeACL(ctx context.Context, tx *sql.Tx, urlID int64,
+	user string,
+) error {
+	ctx, span := startSpan(ctx, "removeACL")
+	defer span.End()
+
+	const q = `
+DELETE FROM acl
+WHERE url_id = $1
+    AND "user" = $2;
+`
+
+	if _, err := tx.ExecContext(ctx, q, urlID, user); err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return nil
+}
+
+// withSavepoint runs f within a savepoint of tx. If f fails, tx is rolled back
+// to the savepoint, so that it remains usable, and the error is returned.
+func withSavepoint(ctx context.Context, tx *sql.Tx, f func() error) error {
+	if _, err := tx.ExecContext(ctx, "SAVEPOINT sp;"); err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	if err := f(); err != nil {
+		if _, rerr := tx.ExecContext(ctx,
+			"ROLLBACK TO SAVEPOINT sp;"); rerr != nil {
+			return fmt.Errorf("%w: %w: %w", ErrFailedRollback, rerr, err)
+		}
+
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, "RELEASE SAVEPOINT sp;"); err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return nil
+}
+
+// addHit adds a hit to the specific URL.
+func addHit(ctx context.Context, tx *sql.Tx, urlID int64, ip net.IP,
+	agent string, referrer *string,
+) error {
+	ctx, span := startSpan(ctx, "addHit")
+	defer span.End()
+
+	if _, err := exec(ctx, tx, addHitQuery, urlID, ip.String(), agent,
+		referrer); err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return nil
+}
+
+// hitAlert tells that a URL is running out of hits. Text makes it readable as
+// a Slack message.
+type hitAlert struct {
+	Name    string `json:"name"`
+	Hits    int64  `json:"hits"`
+	MaxHits int64  `json:"max_hits"`
+	Text    string `json:"text"`
+}
+
+// takeHitAlert marks the URL with the given ID alerted about if its hits have
+// reached percent of its maximum, returning the alert. URLs without a maximum
+// or already alerted about return sql.ErrNoRows, so each URL is alerted about
+// once.
+func takeHitAlert(ctx context.Context, tx *sql.Tx, urlID int64,
+	percent int,
+) (hitAlert, error) {
+	ctx, span := startSpan(ctx, "takeHitAlert")
+	defer span.End()
+
+	const q = `
+UPDATE
+    urls
+SET
+    hit_alert_at = now()
+WHERE
+    id = $1
+    AND hit_alert_at IS NULL
+    AND max_hits IS NOT NULL
+    AND hits * 100 >= max_hits * $2
+RETURNING
+    name,
+    hits,
+    max_hits;
+`
+
+	var a hitAlert
+
+	//nolint:execinquery
+	if err := tx.QueryRowContext(ctx, q, urlID, percent).Scan(&a.Name,
+		&a.Hits, &a.MaxHits); err != nil {
+		return hitAlert{}, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	a.Text = fmt.Sprintf("Link %s has had %d of its %d hits", a.Name, a.Hits,
+		a.MaxHits)
+
+	return a, nil
+}
+
+// hit is a single recorded hit of a URL. Missing values are empty.
+type hit struct {
+	Created    time.Time `json:"created"`
+	RemoteHost string    `json:"remotehost"`
+	Referrer   string    `json:"referrer"`
+	Agent      string    `json:"agent"`
+}
+
+// hitsForURL iterates over the hits of the URL with the given ID, oldest
+// first. Iteration stops at the first error.
+func hitsForURL(ctx context.Context, tx *sql.Tx, urlID int64) iter.Seq2[hit,
+	error,
+] {
+	const q = `
+SELECT
+    created,
+    COALESCE(host(remotehost), ''),
+    COALESCE(referrer, ''),
+    COALESCE(agent, '')
+FROM
+    hits
+WHERE
+    url_id = $1
+ORDER BY
+    created;
+`
+
+	return func(yield func(hit, error) bool) {
+		ctx, span := startSpan(ctx, "hitsForURL")
+		defer span.End()
+
+		//nolint:sqlclosecheck
+		rows, err := tx.QueryContext(ctx, q, urlID)
+		if err != nil {
+			yield(hit{}, fmt.Errorf("failed querying DB: %w", err))
+
+			return
+		}
+
+		defer func(rows *sql.Rows) {
+			if err = rows.Close(); err != nil {
+				panic(err)
+			}
+		}(rows)
+
+		for rows.Next() {
+			var h hit
+
+			if err = rows.Scan(&h.Created, &h.RemoteHost, &h.Referrer,
+				&h.Agent); err != nil {
+				yield(hit{}, fmt.Errorf("failed querying DB: %w", err))
+
+				return
+			}
+
+			if !yield(h, nil) {
+				return
+			}
+		}
+
+		if err = rows.Err(); err != nil {
+			yield(hit{}, fmt.Errorf("failed querying DB: %w", err))
+		}
+	}
+}
+
+// exportURL is a URL of a user in an export.
+type exportURL struct {
+	Name    string    `json:"name"`
+	URL     string    `json:"url"`
+	Hits    int64     `json:"hits"`
+	Created time.Time `json:"created"`
+}
+
+// exportURLs iterates over the URLs owned by user, ordered by name.
+func exportURLs(ctx context.Context, tx *sql.Tx, user string) iter.Seq2[
+	exportURL, error,
+] {
+	const q = `
+SELECT
+    name,
+    url,
+    hits,
+    created
+FROM
+    urls
+WHERE
+    "user" = $1
+    AND deleted_at IS NULL
+ORDER BY
+    name;
+`
+
+	return func(yield func(exportURL, error) bool) {
+		ctx, span := startSpan(ctx, "exportURLs")
+		defer span.End()
+
+		//nolint:sqlclosecheck
+		rows, err := tx.QueryContext(ctx, q, user)
+		if err != nil {
+			yield(exportURL{}, fmt.Errorf("failed querying DB: %w", err))
+
+			return
+		}
+
+		defer func(rows *sql.Rows) {
+			if err = rows.Close(); err != nil {
+				panic(err)
+			}
+		}(rows)
+
+		for rows.Next() {
+			var u exportURL
+
+			if err = rows.Scan(&u.Name, &u.URL, &u.Hits,
+				&u.Created); err != nil {
+				yield(exportURL{}, fmt.Errorf("failed querying DB: %w", err))
+
+				return
+			}
+
+			if !yield(u, nil) {
+				return
+			}
+		}
+
+		if err = rows.Err(); err != nil {
+			yield(exportURL{}, fmt.Errorf("failed querying DB: %w", err))
+		}
+	}
+}
+
+// hitsPage returns at most limit hits of the URL with the given ID, newest
+// first, skipping offset hits.
+func hitsPage(ctx context.Context, tx *sql.Tx, urlID int64, limit,
+	offset int,
+) ([]hit, error) {
+	ctx, span := startSpan(ctx, "hitsPage")
+	defer span.End()
+
+	const q = `
+SELECT
+    created,
+    COALESCE(host(remotehost), ''),
+    COALESCE(referrer, ''),
+    COALESCE(agent, '')
+FROM
+    hits
+WHERE
+    url_id = $1
+ORDER BY
+    created DESC
+LIMIT $2 OFFSET $3;
+`
+
+	//nolint:sqlclosecheck
+	rows, err := tx.QueryContext(ctx, q, urlID, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	defer func(rows *sql.Rows) {
+		if err = rows.Close(); err != nil {
+			panic(err)
+		}
+	}(rows)
+
+	hits := []hit{}
+
+	for rows.Next() {
+		var h hit
+
+		if err = rows.Scan(&h.Created, &h.RemoteHost, &h.Referrer,
+			&h.Agent); err != nil {
+			return nil, fmt.Errorf("failed querying DB: %w", err)
+		}
+
+		hits = append(hits, h)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return hits, nil
+}
+
+// dayCount is the number of hits on a day.
+type dayCount struct {
+	Day   time.Time `json:"day"`
+	Count int64     `json:"count"`
+}
+
+// hitsByDay counts the hits of the URL with the given ID per UTC day for the
+// days ending on the day of until, oldest first. Days without hits are
+// included with zero counts.
+func hitsByDay(ctx context.Context, tx *sql.Tx, urlID int64, until time.Time,
+	days int,
+) ([]dayCount, error) {
+	ctx, span := startSpan(ctx, "hitsByDay")
+	defer span.End()
+
+	const q = `
+SELECT
+    day AT TIME ZONE 'UTC',
+    COUNT(hits.created)
+FROM
+    generate_series(
+        date_trunc('day', $2::timestamptz AT TIME ZONE 'UTC')
+            - ($3::integer - 1) * interval '1 day',
+        date_trunc('day', $2::timestamptz AT TIME ZONE 'UTC'),
+        interval '1 day') AS day
+    LEFT JOIN hits ON hits.url_id = $1
+        AND date_trunc('day', hits.created AT TIME ZONE 'UTC') = day
+GROUP BY
+    day
+ORDER BY
+    day;
+`
+
+	//nolint:sqlclosecheck
+	rows, err := tx.QueryContext(ctx, q, urlID, until, days)
+	if err != nil {
+		return nil, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	defer func(rows *sql.Rows) {
+		if err = rows.Close(); err != nil {
+			panic(err)
+		}
+	}(rows)
+
+	counts := make([]dayCount, 0, days)
+
+	for rows.Next() {
+		var c dayCount
+
+		if err = rows.Scan(&c.Day, &c.Count); err != nil {
+			return nil, fmt.Errorf("failed querying DB: %w", err)
+		}
+
+		c.Day = c.Day.UTC()
+		counts = append(counts, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return counts, nil
+}
+
+// uniqueVisitors counts the distinct remote hosts of the hits of the URL with
+// the given ID, since the given time unless it is zero. IPv4-mapped IPv6
+// addresses count as the IPv4 address.
+func uniqueVisitors(ctx context.Context, tx *sql.Tx, urlID int64,
+	since time.Time,
+) (int64, error) {
+	ctx, span := startSpan(ctx, "uniqueVisitors")
+	defer span.End()
+
+	const q = `
+SELECT
+    COUNT(DISTINCT regexp_replace(host(remotehost), '^::ffff:', ''))
+FROM
+    hits
+WHERE
+    url_id = $1
+    AND ($2::timestamptz IS NULL OR created >= $2);
+`
+
+	var visitors int64
+
+	if err := tx.QueryRowContext(ctx, q, urlID, sql.NullTime{
+		Time:  since,
+		Valid: !since.IsZero(),
+	}).Scan(&visitors); err != nil {
+		return 0, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return visitors, nil
+}
+
+// directReferrer stands for hits without a referrer in referrer counts.
+const directReferrer = "direct"
+
+// referrerCount is the number of hits from a referrer.
+type referrerCount struct {
+	Referrer string `json:"referrer"`
+	Count    int64  `json:"count"`
+}
+
+// topReferrers counts the hits of the URL with the given ID per referrer, most
+// common first. Hits without a referrer are counted as directReferrer.
+func topReferrers(ctx context.Context, tx *sql.Tx, urlID int64, limit,
+	offset int,
+) ([]referrerCount, error) {
+	ctx, span := startSpan(ctx, "topReferrers")
+	defer span.End()
+
+	const q = `
+SELECT
+    COALESCE(NULLIF(referrer, ''), $2) AS source,
+    COUNT(*)
+FROM
+    hits
+WHERE
+    url_id = $1
+GROUP BY
+    source
+ORDER BY
+    2 DESC,
+    source
+LIMIT $3 OFFSET $4;
+`
+
+	//nolint:sqlclosecheck
+	rows, err := tx.QueryContext(ctx, q, urlID, directReferrer, limit, offset)
+	if err != nil {
+		return nil, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	defer func(rows *sql.Rows) {
+		if err = rows.Close(); err != nil {
+			panic(err)
+		}
+	}(rows)
+
+	counts := []referrerCount{}
+
+	for rows.Next() {
+		var c referrerCount
+
+		if err = rows.Scan(&c.Referrer, &c.Count); err != nil {
+			return nil, fmt.Errorf("failed querying DB: %w", err)
+		}
+
+		counts = append(counts, c)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return counts, nil
+}
+
+// agentStats are the hits of a URL per browser and operating system.
+type agentStats struct {
+	Browsers map[string]int64 `json:"browsers"`
+	OS       map[string]int64 `json:"os"`
+}
+
+// statsByAgent counts the hits of the URL with the given ID per browser and
+// operating system, see parseUserAgent.
+func statsByAgent(ctx context.Context, tx *sql.Tx, urlID int64) (agentStats,
+	error,
+) {
+	ctx, span := startSpan(ctx, "statsByAgent")
+	defer span.End()
+
+	const q = `
+SELECT
+    COALESCE(agent, ''),
+    COUNT(*)
+FROM
+    hits
+WHERE
+    url_id = $1
+GROUP BY
+    1;
+`
+
+	stats := agentStats{
+		Browsers: map[string]int64{},
+		OS:       map[string]int64{},
+	}
+
+	//nolint:sqlclosecheck
+	rows, err := tx.QueryContext(ctx, q, urlID)
+	if err != nil {
+		return stats, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	defer func(rows *sql.Rows) {
+		if err = rows.Close(); err != nil {
+			panic(err)
+		}
+	}(rows)
+
+	for rows.Next() {
+		var (
+			agent string
+			count int64
+		)
+
+		if err = rows.Scan(&agent, &count); err != nil {
+			return stats, fmt.Errorf("failed querying DB: %w", err)
+		}
+
+		browser, os := parseUserAgent(agent)
+		stats.Browsers[browser] += count
+		stats.OS[os] += count
+	}
+
+	if err = rows.Err(); err != nil {
+		return stats, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return stats, nil
+}
+
+// addURL adds a new URL to the database. Blocked targets return a wrapped
+// ErrTargetBlocked.
+func addURL(ctx context.Context, tx *sql.Tx, name, url, user string,
+	opts urlOptions,
+) error {
+	ctx, span := startSpan(ctx, "addURL")
+	defer span.End()
+
+	const q = `
+INSERT INTO urls (
+    name,
+    url,
+    "user",
+    fragment,
+    userinfo,
+    headers,
+    code,
+    expires_at,
+    max_hits,
+    password_hash)
+VALUES (
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    $6,
+    NULLIF($7, 0),
+    $8,
+    NULLIF($9, 0),
+    NULLIF($10, ''));
+`
+
+	blocked, err := blockedTarget(ctx, tx, url)
+	if err != nil {
+		return err
+	}
+
+	if blocked {
+		return fmt.Errorf("%w: %s", ErrTargetBlocked, url)
+	}
+
+	headers, err := encodeHeaders(opts.Headers)
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.ExecContext(ctx, q, name, url, user, opts.Fragment,
+		opts.Userinfo, headers, opts.Code, opts.ExpiresAt,
+		opts.MaxHits, opts.PasswordHash); err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return nil
+}
+
+// encodeHeaders encodes headers for the headers column.
+func encodeHeaders(headers map[string]string) (string, error) {
+	if len(headers) == 0 {
+		return "{}", nil
+	}
+
+	b, err := json.Marshal(headers)
+	if err != nil {
+		return "", fmt.Errorf("failed encoding headers: %w", err)
+	}
+
+	return string(b), nil
+}
+
+// countURLsForUser returns the number of URLs owned by the given user.
+func countURLsForUser(ctx context.Context, tx *sql.Tx, user string) (int,
+	error,
+) {
+	ctx, span := startSpan(ctx, "countURLsForUser")
+	defer span.End()
+
+	const q = `
+SELECT
+    count(*)
+FROM
+    urls
+WHERE
+    "user" = $1
+    AND deleted_at IS NULL;
+`
+
+	var count int
+
+	if err := tx.QueryRowContext(ctx, q, user).Scan(&count); err != nil {
+		return 0, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return count, nil
+}
+
+// linkQuota returns the maximum number of URLs for the given user, falling
+// back to def when the user has no override.
+func linkQuota(ctx context.Context, tx *sql.Tx, user string, def int) (int,
+	error,
+) {
+	ctx, span := startSpan(ctx, "linkQuota")
+	defer span.End()
+
+	const q = `
+SELECT
+    COALESCE((
+        SELECT
+            max_links
+        FROM
+            quotas
+        WHERE
+            "user" = $1), $2);
+`
+
+	var limit int
+
+	if err := tx.QueryRowContext(ctx, q, user, def).Scan(&limit); err != nil {
+		return 0, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return limit, nil
+}
+
+// setQuota overrides the maximum number of URLs for the given user.
+func setQuota(ctx context.Context, tx *sql.Tx, user string,
+	maxLinks int,
+) error {
+	ctx, span := startSpan(ctx, "setQuota")
+	defer span.End()
+
+	const q = `
+INSERT INTO quotas (
+    "user",
+    max_links)
+VALUES (
+    $1,
+    $2)
+ON CONFLICT ("user")
+    DO UPDATE SET
+        max_links = EXCLUDED.max_links;
+`
+
+	if _, err := tx.ExecContext(ctx, q, user, maxLinks); err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return nil
+}
+
+// recountHits sets the hit counts of up to limit URLs with IDs after the given
+// one from the hits table. It returns the last ID handled, 0 when there were
+// none left, and the number of counts that changed.
+func recountHits(ctx context.Context, tx *sql.Tx, after int64, limit int) (
+	int64, int64, error,
+) {
+	ctx, span := startSpan(ctx, "recountHits")
+	defer span.End()
+
+	// lock first, so that the counts below see all committed hits and
+	// concurrent redirects wait for the new counts
+	const lockQ = `
+SELECT
+    COALESCE(max(id), 0)
+FROM (
+    SELECT
+        id
+    FROM
+        urls
+    WHERE
+        id > $1
+    ORDER BY
+        id
+    LIMIT $2
+    FOR UPDATE) AS batch;
+`
+
+	const q = `
+UPDATE
+    urls
+SET
+    hits = counts.hits
+FROM (
+    SELECT
+        urls.id,
+        count(hits.url_id) AS hits
+    FROM
+        urls
+        LEFT JOIN hits ON hits.url_id = urls.id
+    WHERE
+        urls.id > $1
+        AND urls.id <= $2
+    GROUP BY
+        urls.id) AS counts
+WHERE
+    urls.id = counts.id
+    AND urls.hits <> counts.hits;
+`
+
+	var last int64
+
+	if err := tx.QueryRowContext(ctx, lockQ, after, limit).Scan(
+		&last); err != nil {
+		return 0, 0, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	if last == 0 {
+		return 0, 0, nil
+	}
+
+	res, err := tx.ExecContext(ctx, q, after, last)
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	updated, err := res.RowsAffected()
+	if err != nil {
+		return 0, 0, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return last, updated, nil
+}
+
+// urlQuery selects a page of the links of a user.
+type urlQuery struct {
+	// Search matches names and URLs containing it, case insensitively,
+	// empty for all
+	Search string
+	// Limit is the most links returned, 0 for all
+	Limit int
+	// Offset is the number of links skipped
+	Offset int
+	// Sort is the key of urlSortColumns to order by, empty for created
+	Sort string
+	// Desc reverses the order
+	Desc bool
+}
+
+// urlSortColumns are the columns links can be ordered by, by sort key. Only
+// these reach the SQL.
+//
+//nolint:gochecknoglobals
+var urlSortColumns = map[string]string{
+	"name":    "name",
+	"hits":    "hits",
+	"created": "created",
+}
+
+// orderBy returns the ORDER BY clause of query, ties broken by ID.
+func (query urlQuery) orderBy() (string, error) {
+	col, ok := urlSortColumns[cmp.Or(query.Sort, "created")]
+	if !ok {
+		return "", fmt.Errorf("%w: %s", ErrInvalidSort, query.Sort)
+	}
+
+	dir := "ASC"
+	if query.Desc {
+		dir = "DESC"
+	}
+
+	return col + " " + dir + ", id " + dir, nil
+}
+
+// likeContaining returns an ILIKE pattern matching strings containing s.
+func likeContaining(s string) string {
+	return "%" + strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).
+		Replace(s) + "%"
+}
+
+// urlsForUser returns all the links of user, newest first.
+func urlsForUser(ctx context.Context, tx *sql.Tx, user string) ([]URL,
+	error,
+) {
+	//nolint:exhaustruct
+	urls, _, err := searchURLsForUser(ctx, tx, user, urlQuery{Desc: true})
+
+	return urls, err
+}
+
+// searchURLsForUser returns the links of user matching query in its order,
+// and the number of all matching links. The number is 0 past the last page.
+func searchURLsForUser(ctx context.Context, tx *sql.Tx, user string,
+	query urlQuery,
+) ([]URL, int, error) {
+	ctx, span := startSpan(ctx, "searchURLsForUser")
+	defer span.End()
+
+	const q = `
+SELECT
+    id,
+    name,
+    url,
+    "user",
+    hits,
+    created,
+    expires_at,
+    COALESCE(expires_at <= now(), FALSE),
+    COALESCE(max_hits, 0),
+    password_hash IS NOT NULL,
+    (
+        SELECT
+            COUNT(DISTINCT regexp_replace(host(remotehost), '^::ffff:', ''))
+        FROM
+            hits
+        WHERE
+            url_id = urls.id),
+    COUNT(*) OVER ()
+FROM
+    urls
+WHERE
+    "user" = $1
+    AND deleted_at IS NULL
+    AND ($2 = ''
+        OR name ILIKE $2
+        OR url ILIKE $2)
+ORDER BY
+    %s
+LIMIT $3 OFFSET $4;
+`
+
+	order, err := query.orderBy()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	var pattern string
+	if query.Search != "" {
+		pattern = likeContaining(query.Search)
+	}
+
+	// no limit for NULL
+	var limit *int
+	if query.Limit > 0 {
+		limit = &query.Limit
+	}
+
+	//nolint:sqlclosecheck,gosec // order is from urlSortColumns
+	rows, err := tx.QueryContext(ctx, fmt.Sprintf(q, order), user, pattern,
+		limit, query.Offset)
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	defer func(rows *sql.Rows) {
+		if err = rows.Close(); err != nil {
+			panic(err)
+		}
+	}(rows)
+
+	urls := []URL{}
+	total := 0
+
+	for rows.Next() {
+		var u URL
+
+		if err = rows.Scan(&u.ID, &u.Name, &u.URL, &u.User, &u.Hits,
+			&u.Created, &u.ExpiresAt, &u.Expired, &u.MaxHits,
+			&u.Protected, &u.Visitors, &total); err != nil {
+			return nil, 0, fmt.Errorf("failed querying DB: %w", err)
+		}
+
+		urls = append(urls, u)
+	}
+
+	err = rows.Err()
+	if err != nil {
+		return nil, 0, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return urls, total, nil
+}
+
+// topLinksLimit is the number of most popular links in a summary.
+const topLinksLimit = 5
+
+// topLink is one of the most popular links of a user, or of everyone.
+type topLink struct {
+	Name string `json:"name"`
+	URL  string `json:"url"`
+	User string `json:"user,omitempty"`
+	Hits int64  `json:"hits"`
+}
+
+// summary aggregates all the links of a user.
+type summary struct {
+	Links    int64     `json:"links"`
+	Hits     int64     `json:"hits"`
+	Visitors int64     `json:"visitors"`
+	Top      []topLink `json:"top"`
+}
+
+// userSummary returns the summary of the links of user. Visitors are counted
+// like by uniqueVisitors.
+func userSummary(ctx context.Context, tx *sql.Tx, user string) (summary,
+	error,
+) {
+	ctx, span := startSpan(ctx, "userSummary")
+	defer span.End()
+
+	const q = `
+SELECT
+    count(*),
+    COALESCE(sum(hits), 0),
+    (
+        SELECT
+            count(DISTINCT regexp_replace(host(h.remotehost), '^::ffff:', ''))
+        FROM
+            hits h
+            JOIN urls u ON u.id = h.url_id
+        WHERE
+            u."user" = $1
+            AND u.deleted_at IS NULL)
+FROM
+    urls
+WHERE
+    "user" = $1
+    AND deleted_at IS NULL;
+`
+
+	const qTop = `
+SELECT
+    name,
+    url,
+    hits
+FROM
+    urls
+WHERE
+    "user" = $1
+    AND deleted_at IS NULL
+ORDER BY
+    hits DESC,
+    name
+LIMIT $2;
+`
+
+	s := summary{Top: []topLink{}} //nolint:exhaustruct
+
+	if err := tx.QueryRowContext(ctx, q, user).Scan(&s.Links, &s.Hits,
+		&s.Visitors); err != nil {
+		return summary{}, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	//nolint:sqlclosecheck
+	rows, err := tx.QueryContext(ctx, qTop, user, topLinksLimit)
+	if err != nil {
+		return summary{}, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	defer func(rows *sql.Rows) {
+		if err = rows.Close(); err != nil {
+			panic(err)
+		}
+	}(rows)
+
+	for rows.Next() {
+		var l topLink
+
+		if err = rows.Scan(&l.Name, &l.URL, &l.Hits); err != nil {
+			return summary{}, fmt.Errorf("failed querying DB: %w", err)
+		}
+
+		s.Top = append(s.Top, l)
+	}
+
+	if err = rows.Err(); err != nil {
+		return summary{}, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return s, nil
+}
+
+// topURLs returns the limit most popular links of all users.
+func topURLs(ctx context.Context, tx *sql.Tx, limit int) ([]topLink, error) {
+	ctx, span := startSpan(ctx, "topURLs")
+	defer span.End()
+
+	const q = `
+SELECT
+    name,
+    url,
+    "user",
+    hits
+FROM
+    urls
+WHERE
+    deleted_at IS NULL
+ORDER BY
+    hits DESC,
+    name
+LIMIT $1;
+`
+
+	//nolint:sqlclosecheck
+	rows, err := tx.QueryContext(ctx, q, limit)
+	if err != nil {
+		return nil, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	defer func(rows *sql.Rows) {
+		if err = rows.Close(); err != nil {
+			panic(err)
 		}
 	}(rows)
 
-	urls := []map[string]string{}
+	top := []topLink{}
 
 	for rows.Next() {
-		var (
-			name, url string
-			hits      int
-		)
+		var l topLink
 
-		if err = rows.Scan(&name, &url, &hits); err != nil {
+		if err = rows.Scan(&l.Name, &l.URL, &l.User, &l.Hits); err != nil {
 			return nil, fmt.Errorf("failed querying DB: %w", err)
 		}
 
-		urls = append(urls, map[string]string{
-			"name": name,
-			"url":  url,
-			"hits": strconv.Itoa(hits),
-		})
+		top = append(top, l)
 	}
 
-	err = rows.Err()
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return top, nil
+}
+
+// addAPIToken stores the hash of an API token of user.
+func addAPIToken(ctx context.Context, tx *sql.Tx, hash, user string) error {
+	ctx, span := startSpan(ctx, "addAPIToken")
+	defer span.End()
+
+	const q = `
+INSERT INTO api_tokens (hash, "user")
+    VALUES ($1, $2);
+`
+
+	if _, err := tx.ExecContext(ctx, q, hash, user); err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return nil
+}
+
+// userForAPIToken returns the user of the API token with the given hash and,
+// with touch, marks the token used. Unknown tokens return a wrapped
+// sql.ErrNoRows.
+func userForAPIToken(ctx context.Context, tx *sql.Tx, hash string,
+	touch bool,
+) (string, error) {
+	ctx, span := startSpan(ctx, "userForAPIToken")
+	defer span.End()
+
+	q := `
+SELECT
+    "user"
+FROM
+    api_tokens
+WHERE
+    hash = $1;
+`
+	if touch {
+		q = `
+UPDATE
+    api_tokens
+SET
+    last_used = now()
+WHERE
+    hash = $1
+RETURNING
+    "user";
+`
+	}
+
+	var user string
+
+	if err := tx.QueryRowContext(ctx, q, hash).Scan(&user); err != nil {
+		return "", fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return user, nil
+}
+
+// blockTarget blocks links to target, an exact URL or a domain, see
+// blockedTarget.
+func blockTarget(ctx context.Context, tx *sql.Tx, target, user string) error {
+	ctx, span := startSpan(ctx, "blockTarget")
+	defer span.End()
+
+	const q = `
+INSERT INTO blocked_targets (target, "user")
+    VALUES ($1, $2)
+ON CONFLICT (target)
+    DO NOTHING;
+`
+
+	if _, err := tx.ExecContext(ctx, q, target, user); err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return nil
+}
+
+// unblockTarget removes the block of target. If there is none, sql.ErrNoRows
+// is returned.
+func unblockTarget(ctx context.Context, tx *sql.Tx, target string) error {
+	ctx, span := startSpan(ctx, "unblockTarget")
+	defer span.End()
+
+	const q = `
+DELETE FROM blocked_targets
+WHERE target = $1;
+`
+
+	res, err := tx.ExecContext(ctx, q, target)
+	if err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	if n == 0 {
+		return fmt.Errorf("failed unblocking %s: %w", target, sql.ErrNoRows)
+	}
+
+	return nil
+}
+
+// blockedTarget tells whether links to u are blocked, either by u itself or
+// by the domain of u or any of its parent domains.
+func blockedTarget(ctx context.Context, tx *sql.Tx, u string) (bool, error) {
+	ctx, span := startSpan(ctx, "blockedTarget")
+	defer span.End()
+
+	const q = `
+SELECT
+    EXISTS (
+        SELECT
+            1
+        FROM
+            blocked_targets
+        WHERE
+            target = $1
+            OR target = $2
+            OR right($2, length(target) + 1) = '.' || target);
+`
+
+	var host string
+
+	if parsed, err := url.Parse(u); err == nil {
+		host = strings.TrimSuffix(strings.ToLower(parsed.Hostname()), ".")
+	}
+
+	var blocked bool
+
+	if err := tx.QueryRowContext(ctx, q, u, host).Scan(&blocked); err != nil {
+		return false, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return blocked, nil
+}
+
+// Actions recorded in the audit log.
+const (
+	auditCreate     = "create"
+	auditDelete     = "delete"
+	auditRegenerate = "regenerate"
+	auditUndelete   = "undelete"
+	auditUpdate     = "update"
+)
+
+// auditEntry is an action of a user on a URL. Missing values are empty.
+type auditEntry struct {
+	Created    time.Time `json:"created"`
+	User       string    `json:"user"`
+	Action     string    `json:"action"`
+	Name       string    `json:"name"`
+	RemoteHost string    `json:"remotehost"`
+}
+
+// addAuditEntry records action by user on the named URL from ip, nil if
+// unknown.
+func addAuditEntry(ctx context.Context, tx *sql.Tx, user, action, name string,
+	ip net.IP,
+) error {
+	ctx, span := startSpan(ctx, "addAuditEntry")
+	defer span.End()
+
+	const q = `
+INSERT INTO audit ("user", action, name, remotehost)
+    VALUES ($1, $2, $3, $4::inet);
+`
+
+	if _, err := tx.ExecContext(ctx, q, user, action, name, sql.NullString{
+		String: ip.String(),
+		Valid:  ip != nil,
+	}); err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return nil
+}
+
+// auditLog returns a page of the audit log, newest first.
+func auditLog(ctx context.Context, tx *sql.Tx, limit, offset int) (
+	[]auditEntry, error,
+) {
+	ctx, span := startSpan(ctx, "auditLog")
+	defer span.End()
+
+	const q = `
+SELECT
+    created,
+    "user",
+    action,
+    name,
+    COALESCE(host(remotehost), '')
+FROM
+    audit
+ORDER BY
+    created DESC
+LIMIT $1 OFFSET $2;
+`
+
+	//nolint:sqlclosecheck
+	rows, err := tx.QueryContext(ctx, q, limit, offset)
 	if err != nil {
 		return nil, fmt.Errorf("failed querying DB: %w", err)
 	}
 
-	return urls, nil
+	defer func(rows *sql.Rows) {
+		if err = rows.Close(); err != nil {
+			panic(err)
+		}
+	}(rows)
+
+	entries := []auditEntry{}
+
+	for rows.Next() {
+		var e auditEntry
+
+		if err = rows.Scan(&e.Created, &e.User, &e.Action, &e.Name,
+			&e.RemoteHost); err != nil {
+			return nil, fmt.Errorf("failed querying DB: %w", err)
+		}
+
+		entries = append(entries, e)
+	}
+
+	if err = rows.Err(); err != nil {
+		return nil, fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	return entries, nil
+}
+
+// backupURL is a URL with everything related to it in a backup.
+type backupURL struct {
+	Created      time.Time         `json:"created"`
+	Name         string            `json:"name"`
+	URL          string            `json:"url"`
+	User         string            `json:"user"`
+	Hits         int64             `json:"hits"`
+	Fragment     string            `json:"fragment,omitempty"`
+	Userinfo     string            `json:"userinfo,omitempty"`
+	Headers      map[string]string `json:"headers,omitempty"`
+	Code         int               `json:"code,omitempty"`
+	ExpiresAt    *time.Time        `json:"expires,omitempty"`
+	MaxHits      int64             `json:"max_hits,omitempty"`
+	PasswordHash string            `json:"password_hash,omitempty"`
+	ACL          []string          `json:"acl,omitempty"`
+}
+
+// backupHit is a hit in a backup, referring to its URL by name.
+type backupHit struct {
+	Created    time.Time `json:"created"`
+	Name       string    `json:"name"`
+	RemoteHost string    `json:"remotehost,omitempty"`
+	Referrer   string    `json:"referrer,omitempty"`
+	Agent      string    `json:"agent,omitempty"`
+}
+
+// backupURLs iterates over all URLs but deleted ones for backing up.
+func backupURLs(ctx context.Context, tx *sql.Tx) iter.Seq2[backupURL, error] {
+	const q = `
+SELECT
+    created,
+    name,
+    url,
+    "user",
+    hits,
+    fragment,
+    userinfo,
+    headers,
+    COALESCE(code, 0),
+    expires_at,
+    COALESCE(max_hits, 0),
+    COALESCE(password_hash, ''),
+    ARRAY (
+        SELECT
+            "user"
+        FROM
+            acl
+        WHERE
+            acl.url_id = urls.id
+        ORDER BY
+            "user")
+FROM
+    urls
+WHERE
+    deleted_at IS NULL
+ORDER BY
+    id;
+`
+
+	return func(yield func(backupURL, error) bool) {
+		ctx, span := startSpan(ctx, "backupURLs")
+		defer span.End()
+
+		//nolint:sqlclosecheck
+		rows, err := tx.QueryContext(ctx, q)
+		if err != nil {
+			yield(backupURL{}, fmt.Errorf("failed querying DB: %w", err))
+
+			return
+		}
+
+		defer func(rows *sql.Rows) {
+			if err = rows.Close(); err != nil {
+				panic(err)
+			}
+		}(rows)
+
+		for rows.Next() {
+			var (
+				u       backupURL
+				headers []byte
+			)
+
+			if err = rows.Scan(&u.Created, &u.Name, &u.URL, &u.User, &u.Hits,
+				&u.Fragment, &u.Userinfo, &headers, &u.Code, &u.ExpiresAt,
+				&u.MaxHits, &u.PasswordHash, pq.Array(&u.ACL)); err != nil {
+				yield(backupURL{}, fmt.Errorf("failed querying DB: %w", err))
+
+				return
+			}
+
+			if err = json.Unmarshal(headers, &u.Headers); err != nil {
+				yield(backupURL{}, fmt.Errorf("failed decoding headers: %w",
+					err))
+
+				return
+			}
+
+			if !yield(u, nil) {
+				return
+			}
+		}
+
+		if err = rows.Err(); err != nil {
+			yield(backupURL{}, fmt.Errorf("failed querying DB: %w", err))
+		}
+	}
+}
+
+// backupHits iterates over all hits for backing up.
+func backupHits(ctx context.Context, tx *sql.Tx) iter.Seq2[backupHit, error] {
+	const q = `
+SELECT
+    h.created,
+    u.name,
+    COALESCE(host(h.remotehost), ''),
+    COALESCE(h.referrer, ''),
+    COALESCE(h.agent, '')
+FROM
+    hits h
+    JOIN urls u ON u.id = h.url_id
+WHERE
+    u.deleted_at IS NULL
+ORDER BY
+    h.created;
+`
+
+	return func(yield func(backupHit, error) bool) {
+		ctx, span := startSpan(ctx, "backupHits")
+		defer span.End()
+
+		//nolint:sqlclosecheck
+		rows, err := tx.QueryContext(ctx, q)
+		if err != nil {
+			yield(backupHit{}, fmt.Errorf("failed querying DB: %w", err))
+
+			return
+		}
+
+		defer func(rows *sql.Rows) {
+			if err = rows.Close(); err != nil {
+				panic(err)
+			}
+		}(rows)
+
+		for rows.Next() {
+			var h backupHit
+
+			if err = rows.Scan(&h.Created, &h.Name, &h.RemoteHost,
+				&h.Referrer, &h.Agent); err != nil {
+				yield(backupHit{}, fmt.Errorf("failed querying DB: %w", err))
+
+				return
+			}
+
+			if !yield(h, nil) {
+				return
+			}
+		}
+
+		if err = rows.Err(); err != nil {
+			yield(backupHit{}, fmt.Errorf("failed querying DB: %w", err))
+		}
+	}
+}
+
+// restoreURL adds a URL from a backup to the database.
+func restoreURL(ctx context.Context, tx *sql.Tx, u backupURL) error {
+	ctx, span := startSpan(ctx, "restoreURL")
+	defer span.End()
+
+	const q = `
+INSERT INTO urls (
+    created,
+    name,
+    url,
+    "user",
+    hits,
+    fragment,
+    userinfo,
+    headers,
+    code,
+    expires_at,
+    max_hits,
+    password_hash)
+VALUES (
+    $1,
+    $2,
+    $3,
+    $4,
+    $5,
+    $6,
+    $7,
+    $8,
+    NULLIF($9, 0),
+    $10,
+    NULLIF($11, 0),
+    NULLIF($12, ''))
+RETURNING
+    id;
+`
+
+	headers, err := encodeHeaders(u.Headers)
+	if err != nil {
+		return err
+	}
+
+	var id int64
+
+	//nolint:execinquery
+	if err := tx.QueryRowContext(ctx, q, u.Created, u.Name, u.URL, u.User,
+		u.Hits, u.Fragment, u.Userinfo, headers, u.Code,
+		u.ExpiresAt, u.MaxHits, u.PasswordHash).Scan(&id); err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	for _, user := range u.ACL {
+		if err := addACL(ctx, tx, id, user); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// overwriteURL points the existing URL with the name of u to its URL when
+// restoring a backup, keeping everything else about the existing URL.
+func overwriteURL(ctx context.Context, tx *sql.Tx, u backupURL) error {
+	ctx, span := startSpan(ctx, "overwriteURL")
+	defer span.End()
+
+	const q = `
+UPDATE
+    urls
+SET
+    url = $2
+WHERE
+    name = $1;
+`
+
+	res, err := tx.ExecContext(ctx, q, u.Name, u.URL)
+	if err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	if n == 0 {
+		return fmt.Errorf("failed overwriting %s: %w", u.Name, sql.ErrNoRows)
+	}
+
+	return nil
+}
+
+// restoreHit adds a hit from a backup to the database. The URL must have been
+// restored first.
+func restoreHit(ctx context.Context, tx *sql.Tx, h backupHit) error {
+	ctx, span := startSpan(ctx, "restoreHit")
+	defer span.End()
+
+	const q = `
+INSERT INTO hits (
+    created,
+    url_id,
+    remotehost,
+    referrer,
+    agent)
+SELECT
+    $1,
+    id,
+    NULLIF($3, '')::inet,
+    NULLIF($4, ''),
+    NULLIF($5, '')
+FROM
+    urls
+WHERE
+    name = $2;
+`
+
+	res, err := tx.ExecContext(ctx, q, h.Created, h.Name, h.RemoteHost,
+		h.Referrer, h.Agent)
+	if err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	n, err := res.RowsAffected()
+	if err != nil {
+		return fmt.Errorf("failed querying DB: %w", err)
+	}
+
+	if n == 0 {
+		return fmt.Errorf("%w: hit for unknown URL %s", ErrInvalidBackup,
+			h.Name)
+	}
+
+	return nil
 }
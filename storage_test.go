@@ -7,9 +7,12 @@ import (
 	"database/sql"
 	"errors"
 	"fmt"
+	"maps"
 	"math/rand"
 	"net"
+	"slices"
 	"testing"
+	"time"
 )
 
 const cExampleCom = "http://example.com"
@@ -57,14 +60,251 @@ func initTx(ctx context.Context, tb testing.TB, conn *sql.Conn) *sql.Tx {
 	tx, err := conn.BeginTx(ctx, nil)
 	checkErr(tb, err)
 
+	// tests may end the transaction themselves
 	tb.Cleanup(func() {
-		err := tx.Commit()
-		checkErr(tb, err)
+		if err := tx.Commit(); !errors.Is(err, sql.ErrTxDone) {
+			checkErr(tb, err)
+		}
 	})
 
 	return tx
 }
 
+// insertHit records a hit of the named URL at created. Empty values are
+// stored as NULL.
+func insertHit(ctx context.Context, tb testing.TB, conn *sql.Conn, name string,
+	created time.Time, ip, referrer, agent string,
+) {
+	tb.Helper()
+
+	_, err := conn.ExecContext(ctx, `
+INSERT INTO hits (created, url_id, remotehost, referrer, agent)
+SELECT
+    $2, id, NULLIF($3, '')::inet, NULLIF($4, ''), NULLIF($5, '')
+FROM
+    urls
+WHERE
+    name = $1`, name, created, ip, referrer, agent)
+	checkErr(tb, err)
+}
+
+func TestHitsPage(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Skipping db tests in short mode.")
+	}
+
+	ctx, db := initDB(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := range 5 {
+		insertHit(ctx, t, db, "foo", start.Add(time.Duration(i)*time.Hour),
+			"127.0.0.1", "", fmt.Sprint("agent", i))
+	}
+
+	tx := initTx(ctx, t, db)
+
+	id, _, err := getIDnUser(ctx, tx, "foo")
+	checkErr(t, err)
+
+	hits, err := hitsPage(ctx, tx, id, 2, 1)
+	checkErr(t, err)
+
+	if len(hits) != 2 || hits[0].Agent != "agent3" ||
+		hits[1].Agent != "agent2" {
+		t.Error("Wrong page:", hits)
+	}
+
+	hits, err = hitsPage(ctx, tx, id, 10, 4)
+	checkErr(t, err)
+
+	if len(hits) != 1 || hits[0].Agent != "agent0" {
+		t.Error("Wrong last page:", hits)
+	}
+
+	hits, err = hitsPage(ctx, tx, id, 10, 5)
+	checkErr(t, err)
+
+	if len(hits) != 0 {
+		t.Error("Wrong page past the end:", hits)
+	}
+}
+
+func TestHitsByDay(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Skipping db tests in short mode.")
+	}
+
+	ctx, db := initDB(t)
+	day := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// late in the day in UTC, but the next day in Helsinki
+	insertHit(ctx, t, db, "foo", day.Add(23*time.Hour), "127.0.0.1", "", "")
+	insertHit(ctx, t, db, "foo", day.Add(48*time.Hour), "127.0.0.1", "", "")
+	insertHit(ctx, t, db, "foo", day.Add(50*time.Hour), "127.0.0.1", "", "")
+
+	tx := initTx(ctx, t, db)
+
+	id, _, err := getIDnUser(ctx, tx, "foo")
+	checkErr(t, err)
+
+	counts, err := hitsByDay(ctx, tx, id, day.Add(60*time.Hour), 4)
+	checkErr(t, err)
+
+	want := []dayCount{
+		{day.AddDate(0, 0, -1), 0},
+		{day, 1},
+		{day.AddDate(0, 0, 1), 0},
+		{day.AddDate(0, 0, 2), 2},
+	}
+
+	if len(counts) != len(want) {
+		t.Fatal("Wrong counts:", counts)
+	}
+
+	for i := range want {
+		if !counts[i].Day.Equal(want[i].Day) || counts[i].Count !=
+			want[i].Count {
+			t.Errorf("Wrong count: got %v , want %v", counts[i], want[i])
+		}
+	}
+}
+
+func TestUniqueVisitors(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Skipping db tests in short mode.")
+	}
+
+	ctx, db := initDB(t)
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i, ip := range []string{
+		"127.0.0.1", "127.0.0.1", "::ffff:127.0.0.1", "192.0.2.1", "2001:db8::1",
+		"2001:db8::1", "2001:db8::2", "",
+	} {
+		insertHit(ctx, t, db, "foo", start.Add(time.Duration(i)*time.Hour), ip,
+			"", "")
+	}
+
+	tx := initTx(ctx, t, db)
+
+	id, _, err := getIDnUser(ctx, tx, "foo")
+	checkErr(t, err)
+
+	testCases := []struct {
+		since time.Time
+		want  int64
+	}{
+		{time.Time{}, 4},
+		{start.Add(3 * time.Hour), 3},
+		{start.Add(6 * time.Hour), 1},
+		{start.Add(24 * time.Hour), 0},
+	}
+
+	for _, tc := range testCases {
+		visitors, err := uniqueVisitors(ctx, tx, id, tc.since)
+		checkErr(t, err)
+
+		if visitors != tc.want {
+			t.Errorf("Wrong visitors since %v: got %d , want %d", tc.since,
+				visitors, tc.want)
+		}
+	}
+
+	urls, err := urlsForUser(ctx, tx, "test")
+	checkErr(t, err)
+
+	if len(urls) != 1 || urls[0].Visitors != 4 {
+		t.Error("Wrong visitors in listing:", urls)
+	}
+}
+
+func TestTopReferrers(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Skipping db tests in short mode.")
+	}
+
+	ctx, db := initDB(t)
+	created := time.Now()
+
+	for _, referrer := range []string{
+		"https://a.example.com/", "", "https://b.example.com/",
+		"https://a.example.com/", "https://a.example.com/",
+	} {
+		insertHit(ctx, t, db, "foo", created, "127.0.0.1", referrer, "")
+	}
+
+	// insertHit stores NULL like addHit, but empty counts as direct too
+	_, err := db.ExecContext(ctx, `
+INSERT INTO hits (url_id, referrer) SELECT id, '' FROM urls WHERE name = 'foo'`)
+	checkErr(t, err)
+
+	tx := initTx(ctx, t, db)
+
+	id, _, err := getIDnUser(ctx, tx, "foo")
+	checkErr(t, err)
+
+	counts, err := topReferrers(ctx, tx, id, 10, 0)
+	checkErr(t, err)
+
+	want := []referrerCount{
+		{"https://a.example.com/", 3},
+		{directReferrer, 2},
+		{"https://b.example.com/", 1},
+	}
+
+	if !slices.Equal(counts, want) {
+		t.Errorf("Wrong referrers: got %v , want %v", counts, want)
+	}
+
+	counts, err = topReferrers(ctx, tx, id, 1, 1)
+	checkErr(t, err)
+
+	if !slices.Equal(counts, want[1:2]) {
+		t.Errorf("Wrong page: got %v , want %v", counts, want[1:2])
+	}
+}
+
+func TestStatsByAgent(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Skipping db tests in short mode.")
+	}
+
+	ctx, db := initDB(t)
+	created := time.Now()
+	firefox := "Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 " +
+		"Firefox/121.0"
+
+	for _, agent := range []string{firefox, firefox, "curl/8.5.0", ""} {
+		insertHit(ctx, t, db, "foo", created, "127.0.0.1", "", agent)
+	}
+
+	tx := initTx(ctx, t, db)
+
+	id, _, err := getIDnUser(ctx, tx, "foo")
+	checkErr(t, err)
+
+	stats, err := statsByAgent(ctx, tx, id)
+	checkErr(t, err)
+
+	if !maps.Equal(stats.Browsers, map[string]int64{
+		"Firefox": 2, "Bot": 1, agentUnknown: 1,
+	}) || !maps.Equal(stats.OS, map[string]int64{
+		"Linux": 2, agentOther: 1, agentUnknown: 1,
+	}) {
+		t.Error("Wrong stats:", stats)
+	}
+}
+
 func TestNewPostgresDB(t *testing.T) {
 	t.Parallel()
 
@@ -88,7 +328,8 @@ func TestAddURL(t *testing.T) {
 	ctx, db := initDB(t)
 	tx := initTx(ctx, t, db)
 
-	err := addURL(ctx, tx, "bar", cExampleCom, "test")
+	err := addURL(ctx, tx, "bar", cExampleCom, "test",
+		urlOptions{}) //nolint:exhaustruct
 	if err != nil {
 		t.Fatal("Error adding URL:", err)
 	}
@@ -159,6 +400,122 @@ func TestRemoveURL(t *testing.T) {
 	}
 }
 
+func TestSoftDelete(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Skipping db tests in short mode.")
+	}
+
+	ctx, db := initDB(t)
+	insertHit(ctx, t, db, "foo", time.Now(), "127.0.0.1", "", "")
+
+	tx := initTx(ctx, t, db)
+
+	checkErr(t, removeURL(ctx, tx, "foo"))
+
+	if _, _, err := getIDnUser(ctx, tx, "foo"); !errors.Is(err,
+		sql.ErrNoRows) {
+		t.Error("Deleted URL found:", err)
+	}
+
+	urls, err := urlsForUser(ctx, tx, "test")
+	checkErr(t, err)
+
+	if len(urls) != 0 {
+		t.Error("Deleted URL listed:", urls)
+	}
+
+	// the row and its hits are kept, and the name stays taken
+	var hits int
+
+	checkErr(t, tx.QueryRowContext(ctx, `SELECT count(*) FROM hits JOIN urls
+ON urls.id = hits.url_id WHERE name = 'foo' AND deleted_at IS NOT NULL`).
+		Scan(&hits))
+
+	if hits != 1 {
+		t.Error("Wrong hits of deleted URL:", hits)
+	}
+
+	for deleted, want := range map[bool]bool{true: true, false: false} {
+		used, err := nameInUse(ctx, tx, "foo", deleted)
+		checkErr(t, err)
+
+		if used != want {
+			t.Errorf("Wrong use of name counting deleted %v: %v", deleted,
+				used)
+		}
+	}
+
+	err = withSavepoint(ctx, tx, func() error {
+		return addURL(ctx, tx, "foo", cExampleCom, "test",
+			urlOptions{}) //nolint:exhaustruct
+	})
+	if !isUniqueViolation(err) {
+		t.Error("Deleted name reused:", err)
+	}
+
+	// undeleting
+	checkErr(t, undeleteURL(ctx, tx, "foo"))
+
+	if _, _, err := getURLnID(ctx, tx, "foo"); err != nil {
+		t.Error("Undeleted URL not found:", err)
+	}
+
+	if err := undeleteURL(ctx, tx, "foo"); !errors.Is(err, sql.ErrNoRows) {
+		t.Error("Undeleted a URL that isn't deleted:", err)
+	}
+
+	// purging
+	checkErr(t, removeURL(ctx, tx, "foo"))
+
+	purged, err := purgeDeleted(ctx, tx, time.Now().Add(-time.Hour))
+	checkErr(t, err)
+
+	if purged != 0 {
+		t.Error("Purged a recently deleted URL")
+	}
+
+	purged, err = purgeDeleted(ctx, tx, time.Now().Add(time.Hour))
+	checkErr(t, err)
+
+	if purged != 1 {
+		t.Error("Wrong number of purged URLs:", purged)
+	}
+
+	checkErr(t, tx.QueryRowContext(ctx, `SELECT count(*) FROM hits`).
+		Scan(&hits))
+
+	if hits != 0 {
+		t.Error("Hits of purged URL kept:", hits)
+	}
+}
+
+func TestUpdateURL(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Skipping db tests in short mode.")
+	}
+
+	ctx, db := initDB(t)
+	tx := initTx(ctx, t, db)
+
+	if err := updateURL(ctx, tx, "foo", "https://example.org", "bar"); !errors.Is(
+		err, sql.ErrNoRows) {
+		t.Error("Updated by other user:", err)
+	}
+
+	checkErr(t, updateURL(ctx, tx, "foo", "https://example.org", "test"))
+
+	u, _, err := getURLnID(ctx, tx, "foo")
+	checkErr(t, err)
+
+	if u != "https://example.org" {
+		t.Error("Wrong URL after update:", u)
+	}
+}
+
 func TestAddHit(t *testing.T) {
 	t.Parallel()
 
@@ -198,18 +555,598 @@ func TestURLsForUser(t *testing.T) {
 	}
 
 	if len(urls) != 1 {
-		t.Error("Got wrong number of URLs:", len(urls))
+		t.Fatal("Got wrong number of URLs:", len(urls))
 	}
 
-	if urls[0]["name"] != "foo" {
+	if urls[0].Name != "foo" {
 		t.Error("Got wrong URLs:", urls)
 	}
 
-	if urls[0]["url"] != cExampleCom {
+	if urls[0].URL != cExampleCom {
 		t.Error("Got wrong URLs:", urls)
 	}
 
-	if urls[0]["hits"] != "0" {
+	if urls[0].Hits != 0 {
 		t.Error("Got wrong URLs:", urls)
 	}
+
+	// typed fields round-trip
+	expires := time.Date(2030, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	checkErr(t, addURL(ctx, tx, "typed", cExampleCom, "test",
+		urlOptions{ExpiresAt: &expires, MaxHits: 3})) //nolint:exhaustruct
+
+	_, err = tx.ExecContext(ctx,
+		`UPDATE urls SET hits = 5000000000 WHERE name = 'typed'`)
+	checkErr(t, err)
+
+	urls, err = urlsForUser(ctx, tx, "test")
+	checkErr(t, err)
+
+	for _, u := range urls {
+		if u.Name != "typed" {
+			continue
+		}
+
+		if u.User != "test" || u.Hits != 5000000000 || u.MaxHits != 3 ||
+			u.Created.IsZero() || !u.ExpiresAt.Equal(expires) ||
+			u.Expired || u.Expires() != "2030-01-02T03:04:05Z" {
+			t.Error("Wrong typed URL:", u)
+		}
+	}
+}
+
+func TestURLExpiry(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Skipping db tests in short mode.")
+	}
+
+	ctx, db := initDB(t)
+	tx := initTx(ctx, t, db)
+
+	for _, tc := range []struct {
+		name    string
+		offset  string
+		expired bool
+	}{
+		{"past", "-1 second", true},
+		{"future", "1 hour", false},
+	} {
+		checkErr(t, addURL(ctx, tx, tc.name, cExampleCom, "test",
+			urlOptions{})) //nolint:exhaustruct
+
+		// relative to the clock of the DB
+		_, err := tx.ExecContext(ctx, `
+UPDATE urls SET expires_at = now() + $2::interval WHERE name = $1`,
+			tc.name, tc.offset)
+		checkErr(t, err)
+
+		_, err = getRedirect(ctx, tx, tc.name, 0)
+		if expired := errors.Is(err, sql.ErrNoRows); expired != tc.expired {
+			t.Errorf("Wrong redirect of %s: %v", tc.name, err)
+		}
+
+		// within grace
+		rd, err := getRedirect(ctx, tx, tc.name, time.Hour)
+		checkErr(t, err)
+
+		if rd.Expired != tc.expired {
+			t.Errorf("Wrong expiry of %s in grace: %v", tc.name, rd.Expired)
+		}
+	}
+
+	urls, err := urlsForUser(ctx, tx, "test")
+	checkErr(t, err)
+
+	for _, u := range urls {
+		if (u.Name == "past") != u.Expired {
+			t.Error("Wrong listing:", u)
+		}
+	}
+}
+
+func TestSearchURLsForUser(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Skipping db tests in short mode.")
+	}
+
+	ctx, db := initDB(t)
+	tx := initTx(ctx, t, db)
+
+	for name, u := range map[string]string{
+		"alpha":       "https://alpha.example.org",
+		"beta":        "https://www.example.net/ALPHA",
+		"under_score": cExampleCom,
+		"underXscore": cExampleCom,
+	} {
+		checkErr(t, addURL(ctx, tx, name, u, "test",
+			urlOptions{})) //nolint:exhaustruct
+	}
+
+	checkErr(t, addURL(ctx, tx, "other", "https://alpha.example.com",
+		"alice", urlOptions{})) //nolint:exhaustruct
+
+	names := func(urls []URL) []string {
+		var names []string
+		for _, u := range urls {
+			names = append(names, u.Name)
+		}
+
+		slices.Sort(names)
+
+		return names
+	}
+
+	// filtering by substring of name or URL
+	for search, want := range map[string][]string{
+		"Alpha": {"alpha", "beta"},
+		"r_s":   {"under_score"},
+		"%":     nil,
+		"nope":  nil,
+	} {
+		//nolint:exhaustruct
+		urls, total, err := searchURLsForUser(ctx, tx, "test",
+			urlQuery{Search: search})
+		checkErr(t, err)
+
+		if got := names(urls); !slices.Equal(got, want) ||
+			total != len(want) {
+			t.Errorf("Wrong URLs for %q: got %v (%d) , want %v", search,
+				got, total, want)
+		}
+	}
+
+	// paging
+	all, total, err := searchURLsForUser(ctx, tx, "test",
+		urlQuery{}) //nolint:exhaustruct
+	checkErr(t, err)
+
+	if len(all) != 5 || total != 5 {
+		t.Fatal("Wrong URLs:", all, total)
+	}
+
+	page, total, err := searchURLsForUser(ctx, tx, "test",
+		urlQuery{Limit: 2, Offset: 1}) //nolint:exhaustruct
+	checkErr(t, err)
+
+	if !slices.Equal(names(page), names(all[1:3])) ||
+		page[0].Name != all[1].Name || total != 5 {
+		t.Error("Wrong page:", page, total)
+	}
+
+	page, _, err = searchURLsForUser(ctx, tx, "test",
+		urlQuery{Limit: 2, Offset: 5}) //nolint:exhaustruct
+	checkErr(t, err)
+
+	if len(page) != 0 {
+		t.Error("Page past the end not empty:", page)
+	}
+}
+
+func TestSortURLs(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Skipping db tests in short mode.")
+	}
+
+	ctx, db := initDB(t)
+	tx := initTx(ctx, t, db)
+
+	// foo is there already
+	for _, name := range []string{"bar", "qux"} {
+		checkErr(t, addURL(ctx, tx, name, cExampleCom, "test",
+			urlOptions{})) //nolint:exhaustruct
+	}
+
+	_, err := tx.ExecContext(ctx, `
+UPDATE
+    urls
+SET
+    hits = CASE name WHEN 'foo' THEN 5 WHEN 'bar' THEN 10 ELSE 1 END,
+    created = CASE name
+        WHEN 'foo' THEN '2020-01-01'::timestamptz
+        WHEN 'bar' THEN '2022-01-01'::timestamptz
+        ELSE '2021-01-01'::timestamptz
+    END`)
+	checkErr(t, err)
+
+	testCases := []struct {
+		sort string
+		desc bool
+		want []string
+	}{
+		{"", true, []string{"bar", "qux", "foo"}},
+		{"created", false, []string{"foo", "qux", "bar"}},
+		{"name", false, []string{"bar", "foo", "qux"}},
+		{"name", true, []string{"qux", "foo", "bar"}},
+		{"hits", true, []string{"bar", "foo", "qux"}},
+		{"hits", false, []string{"qux", "foo", "bar"}},
+	}
+
+	for _, tc := range testCases {
+		urls, _, err := searchURLsForUser(ctx, tx, "test",
+			urlQuery{Sort: tc.sort, Desc: tc.desc}) //nolint:exhaustruct
+		checkErr(t, err)
+
+		var got []string
+		for _, u := range urls {
+			got = append(got, u.Name)
+		}
+
+		if !slices.Equal(got, tc.want) {
+			t.Errorf("Wrong order by %q desc %v: got %v , want %v",
+				tc.sort, tc.desc, got, tc.want)
+		}
+	}
+
+	_, _, err = searchURLsForUser(ctx, tx, "test",
+		urlQuery{Sort: "id; DROP TABLE urls"}) //nolint:exhaustruct
+	if !errors.Is(err, ErrInvalidSort) {
+		t.Error("Unknown sort accepted:", err)
+	}
+}
+
+func TestHitsForURL(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Skipping db tests in short mode.")
+	}
+
+	ctx, db := initDB(t)
+	tx := initTx(ctx, t, db)
+
+	_, id, err := getURLnID(ctx, tx, "foo")
+	if err != nil {
+		t.Fatal("Error getting URL:", err)
+	}
+
+	referrer := cExampleCom
+
+	checkErr(t, addHit(ctx, tx, id, net.IPv4(127, 0, 0, 1), "testagent",
+		&referrer))
+	checkErr(t, addHit(ctx, tx, id, net.IPv6loopback, "testagent", nil))
+
+	// hits within a transaction share their creation time
+	hits := map[string]hit{}
+
+	for h, err := range hitsForURL(ctx, tx, id) {
+		checkErr(t, err)
+
+		hits[h.RemoteHost] = h
+	}
+
+	if len(hits) != 2 {
+		t.Fatal("Got wrong number of hits:", len(hits))
+	}
+
+	if h := hits["127.0.0.1"]; h.Referrer != referrer || h.Agent != "testagent" {
+		t.Error("Got wrong hit:", h)
+	}
+
+	if h := hits["::1"]; h.Referrer != "" || h.Agent != "testagent" {
+		t.Error("Got wrong hit:", h)
+	}
+}
+
+func TestLinkQuota(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Skipping db tests in short mode.")
+	}
+
+	ctx, db := initDB(t)
+	tx := initTx(ctx, t, db)
+
+	limit, err := linkQuota(ctx, tx, "test", 5)
+	checkErr(t, err)
+
+	if limit != 5 {
+		t.Error("Got wrong default quota:", limit)
+	}
+
+	checkErr(t, setQuota(ctx, tx, "test", 10))
+	checkErr(t, setQuota(ctx, tx, "test", 2))
+
+	limit, err = linkQuota(ctx, tx, "test", 5)
+	checkErr(t, err)
+
+	if limit != 2 {
+		t.Error("Got wrong overridden quota:", limit)
+	}
+
+	count, err := countURLsForUser(ctx, tx, "test")
+	checkErr(t, err)
+
+	if count != 1 {
+		t.Error("Got wrong number of URLs:", count)
+	}
+}
+
+func TestACL(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Skipping db tests in short mode.")
+	}
+
+	ctx, db := initDB(t)
+	tx := initTx(ctx, t, db)
+
+	id, _, err := getIDnUser(ctx, tx, "foo")
+	checkErr(t, err)
+
+	checkErr(t, addACL(ctx, tx, id, "bar"))
+	checkErr(t, addACL(ctx, tx, id, "bar"))
+
+	member, err := inACL(ctx, tx, id, "bar")
+	checkErr(t, err)
+
+	if !member {
+		t.Error("User missing from ACL")
+	}
+
+	checkErr(t, removeACL(ctx, tx, id, "bar"))
+
+	member, err = inACL(ctx, tx, id, "bar")
+	checkErr(t, err)
+
+	if member {
+		t.Error("User not removed from ACL")
+	}
+}
+
+func TestWithSavepoint(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Skipping db tests in short mode.")
+	}
+
+	ctx, db := initDB(t)
+	tx := initTx(ctx, t, db)
+
+	err := withSavepoint(ctx, tx, func() error {
+		return removeURL(ctx, tx, "foo")
+	})
+	checkErr(t, err)
+
+	err = withSavepoint(ctx, tx, func() error {
+		_, err := tx.ExecContext(ctx, "SELECT 1/0")
+
+		return err //nolint:wrapcheck
+	})
+	if err == nil {
+		t.Error("Error missing")
+	}
+
+	// still usable, and the successful savepoint was kept
+	if _, _, err := getURLnID(ctx, tx, "foo"); !errors.Is(err,
+		sql.ErrNoRows) {
+		t.Error("Error, should not find URL:", err)
+	}
+}
+
+func TestWithApplicationName(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		dsn  string
+		name string
+		want string
+	}{
+		{"", "urlredir", "application_name='urlredir'"},
+		{"dbname=urlredir", "it's", `dbname=urlredir application_name='it\'s'`},
+		{"application_name=other", "urlredir", "application_name=other"},
+		{"dbname=urlredir", "", "dbname=urlredir"},
+		{
+			"postgres://localhost/urlredir", "urlredir",
+			"dbname='urlredir' host='localhost' application_name='urlredir'",
+		},
+	}
+
+	for _, tc := range testCases {
+		got, err := withApplicationName(tc.dsn, tc.name)
+		checkErr(t, err)
+
+		if got != tc.want {
+			t.Errorf("Wrong DSN for %q: got %s , want %s", tc.dsn, got,
+				tc.want)
+		}
+	}
+}
+
+func TestApplicationName(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Skipping db tests in short mode.")
+	}
+
+	var name string
+
+	checkErr(t, pool.QueryRowContext(context.Background(),
+		"SELECT current_setting('application_name')").Scan(&name))
+
+	if name != conf.ApplicationName {
+		t.Errorf("Wrong application_name: got %s , want %s", name,
+			conf.ApplicationName)
+	}
+}
+
+func TestBlockedTarget(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Skipping db tests in short mode.")
+	}
+
+	ctx, db := initDB(t)
+	tx := initTx(ctx, t, db)
+
+	checkErr(t, blockTarget(ctx, tx, "evil.example", "admin"))
+	checkErr(t, blockTarget(ctx, tx, "https://example.org/phish", "admin"))
+	// blocking twice is fine
+	checkErr(t, blockTarget(ctx, tx, "evil.example", "admin"))
+
+	testCases := []struct {
+		url     string
+		blocked bool
+	}{
+		{"https://evil.example", true},
+		{"https://EVIL.example./login", true},
+		{"http://www.evil.example:8080/", true},
+		{"https://notevil.example", false},
+		{"https://example.org/phish", true},
+		{"https://example.org/phish?x=1", false},
+		{"https://example.org", false},
+		{cExampleCom, false},
+	}
+
+	for _, tc := range testCases {
+		blocked, err := blockedTarget(ctx, tx, tc.url)
+		checkErr(t, err)
+
+		if blocked != tc.blocked {
+			t.Errorf("Wrong block of %s: got %v , want %v", tc.url, blocked,
+				tc.blocked)
+		}
+	}
+
+	err := addURL(ctx, tx, "bad", "https://www.evil.example", "test",
+		urlOptions{}) //nolint:exhaustruct
+	if !errors.Is(err, ErrTargetBlocked) {
+		t.Error("Blocked target added:", err)
+	}
+
+	err = updateURL(ctx, tx, "foo", "https://www.evil.example", "test")
+	if !errors.Is(err, ErrTargetBlocked) {
+		t.Error("Updated to a blocked target:", err)
+	}
+
+	checkErr(t, unblockTarget(ctx, tx, "evil.example"))
+
+	if err := unblockTarget(ctx, tx, "evil.example"); !errors.Is(err,
+		sql.ErrNoRows) {
+		t.Error("Unblocked a target that isn't blocked:", err)
+	}
+
+	checkErr(t, addURL(ctx, tx, "bad", "https://www.evil.example", "test",
+		urlOptions{})) //nolint:exhaustruct
+}
+
+// poolSettings records the settings applied by tunePool.
+type poolSettings struct {
+	maxOpen, maxIdle      int
+	lifetime, maxIdleTime time.Duration
+}
+
+func (p *poolSettings) SetMaxOpenConns(n int)              { p.maxOpen = n }
+func (p *poolSettings) SetMaxIdleConns(n int)              { p.maxIdle = n }
+func (p *poolSettings) SetConnMaxLifetime(d time.Duration) { p.lifetime = d }
+func (p *poolSettings) SetConnMaxIdleTime(d time.Duration) { p.maxIdleTime = d }
+
+func TestTunePool(t *testing.T) {
+	t.Parallel()
+
+	var got poolSettings
+
+	tunePool(&got, &config{ //nolint:exhaustruct
+		DBMaxOpenConns:           20,
+		DBMaxIdleConns:           5,
+		DBConnMaxLifetimeSeconds: 3600,
+		DBConnMaxIdleTimeSeconds: 60,
+	})
+
+	if want := (poolSettings{20, 5, time.Hour, time.Minute}); got != want {
+		t.Errorf("Wrong pool settings: got %+v , want %+v", got, want)
+	}
+
+	// unset values keep the driver defaults
+	untouched := poolSettings{-1, -1, -1, -1}
+	got = untouched
+
+	tunePool(&got, &config{}) //nolint:exhaustruct
+
+	if got != untouched {
+		t.Error("Default pool settings changed:", got)
+	}
+}
+
+func TestMigrationOrder(t *testing.T) {
+	t.Parallel()
+
+	for i, step := range migrations {
+		if step.version != i+1 {
+			t.Errorf("Wrong version of migration %d: %d", i, step.version)
+		}
+	}
+}
+
+func TestMigrate(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Skipping db tests in short mode.")
+	}
+
+	ctx, db := initDB(t)
+	latest := migrations[len(migrations)-1].version
+
+	version := func() int {
+		t.Helper()
+
+		tx := initTx(ctx, t, db)
+
+		v, err := schemaVersion(ctx, tx)
+		checkErr(t, err)
+		checkErr(t, tx.Rollback())
+
+		return v
+	}
+
+	// initDB migrated a fresh schema
+	if v := version(); v != latest {
+		t.Errorf("Wrong version: got %d , want %d", v, latest)
+	}
+
+	// running again is a no-op
+	checkErr(t, ensureSchema(db))
+
+	var applied int
+
+	checkErr(t, db.QueryRowContext(ctx,
+		`SELECT count(*) FROM schema_migrations`).Scan(&applied))
+
+	if applied != len(migrations) {
+		t.Errorf("Wrong number of migrations: got %d , want %d", applied,
+			len(migrations))
+	}
+
+	// a failing step rolls back the steps before it
+	err := migrate(ctx, db, append(slices.Clone(migrations),
+		migration{latest + 1, `CREATE TABLE broken (id integer);`},
+		migration{latest + 2, `SELECT missing FROM broken;`}))
+	if err == nil {
+		t.Error("Broken migration succeeded")
+	}
+
+	if v := version(); v != latest {
+		t.Errorf("Wrong version after failure: got %d , want %d", v, latest)
+	}
+
+	var exists bool
+
+	checkErr(t, db.QueryRowContext(ctx,
+		`SELECT to_regclass('broken') IS NOT NULL`).Scan(&exists))
+
+	if exists {
+		t.Error("Failed migration not rolled back")
+	}
 }
@@ -2,45 +2,219 @@
 
 package main
 
+import (
+	"embed"
+	"html/template"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// staticFiles are the assets of the admin page.
+//
+//go:embed static
+var staticFiles embed.FS //nolint:gochecknoglobals
+
+// staticHandler serves the named file of staticFiles.
+func staticHandler(name string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.ServeFileFS(w, r, staticFiles, "static/"+name)
+	})
+}
+
+// loadAdminTemplate parses the admin page template from the named file. If
+// name is empty, or the file is missing or malformed, the embedded default is
+// used instead so that the admin page keeps working.
+func loadAdminTemplate(name string) *template.Template {
+	def := template.Must(template.New("adminPage").Parse(adminPage))
+
+	if name == "" {
+		return def
+	}
+
+	b, err := os.ReadFile(name)
+	if err != nil {
+		slog.Error("error reading admin template, using default",
+			slog.String("file", name), slog.Any("err", err))
+
+		return def
+	}
+
+	t, err := template.New("adminPage").Parse(string(b))
+	if err != nil {
+		slog.Error("error parsing admin template, using default",
+			slog.String("file", name), slog.Any("err", err))
+
+		return def
+	}
+
+	return t
+}
+
+// adminThemes are the admin page templates per Host.
+type adminThemes struct {
+	def   *template.Template
+	hosts map[string]*template.Template
+}
+
+// loadAdminThemes loads the default admin page template from name and one per
+// host from hosts, see loadAdminTemplate.
+func loadAdminThemes(name string, hosts map[string]string) adminThemes {
+	themes := adminThemes{
+		def:   loadAdminTemplate(name),
+		hosts: make(map[string]*template.Template, len(hosts)),
+	}
+
+	for host, name := range hosts {
+		themes.hosts[strings.ToLower(host)] = loadAdminTemplate(name)
+	}
+
+	return themes
+}
+
+// forHost returns the template for host, ignoring any port, or the default.
+func (t adminThemes) forHost(host string) *template.Template {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+
+	if tmpl, ok := t.hosts[strings.ToLower(host)]; ok {
+		return tmpl
+	}
+
+	return t.def
+}
+
 const adminPage = `
 <html>
 <head>
 <title>URL Shortener</title>
-<script type="text/javascript">
-function deleteLink(name) {
-	var xhr = window.XMLHttpRequest ? new XMLHttpRequest() :
-		new ActiveXObject('Microsoft.HTTP');
-	xhr.open('DELETE', '/' + name);
-	xhr.onreadystatechange = function() {
-		if (xhr.readyState > 3 && xhr.status == 200) {
-			window.location.href = '/_admin';
-		}
-	};
-	xhr.send();
-}
-</script>
+<meta name="csrf-token" content="{{.csrf}}">
+<script src="/_static/admin.js" nonce="{{.nonce}}" defer></script>
 </head>
 <body>
+{{if .created}}<p>Created <a href="/{{.created}}">{{.created}}</a></p>{{end}}
 <p>
 <form action="{{.path}}" method="post">
-<input name="name" id="name" placeholder="name">
+<input type="hidden" name="csrf" value="{{.csrf}}">
+<input name="name" id="name" placeholder="name (random if empty)">
 <input name="url" id="url" placeholder="https://...">
-<input name="user" id="user" placeholder="username" value="{{.user}}">
+<input name="fragment" id="fragment" placeholder="#fragment">
+<input type="number" name="max_hits" id="max_hits" min="1" placeholder="max hits">
+<input type="password" name="password" id="password" placeholder="password" autocomplete="new-password">
+<input type="datetime-local" name="expires" id="expires" title="expires (UTC)">
+<select name="code" id="code">
+<option value="">default</option>
+<option value="301">301 permanent</option>
+<option value="302">302 found</option>
+<option value="307">307 temporary</option>
+<option value="308">308 permanent</option>
+</select>
+<input name="headers" id="headers" placeholder='{"Referrer-Policy": "no-referrer"}'>
+{{if .credentials}}<input name="credentials" id="credentials" placeholder="user:password (visible to visitors)">{{end}}
+<input name="user" id="user" placeholder="username" value="{{.user}}"{{if not .admin}} readonly{{end}}>
 <input type="submit" value="Add">
 </form>
 </p>
 <p>
+<form action="{{.path}}" method="get">
+<input type="search" name="q" id="q" placeholder="search" value="{{.search}}">
+<input type="submit" value="Search">
+</form>
+</p>
+<p>
+Sort by
+{{range .sorts}}<a href="{{.Href}}">{{.Key}}</a>{{if .Current}}{{if .Desc}} &darr;{{else}} &uarr;{{end}}{{end}}
+{{end}}
+</p>
+<p>
 <ul>
 {{range .urls}}
-<li>
-<a href="/{{.name}}">{{.name}}</a>
-<a href="{{.url}}">{{.url}}</a>
-{{.hits}}
-<a href="#" onclick="deleteLink('{{.name}}');">Delete</a>
+<li{{if .Expired}} style="text-decoration: line-through"{{end}}>
+<a href="/{{.Name}}">{{.Name}}</a>
+<a href="{{.URL}}">{{.URL}}</a>
+{{.Hits}}{{if .MaxHits}}/{{.MaxHits}}{{end}} ({{.Visitors}} unique)
+{{if .Protected}}password protected{{end}}
+{{if .ExpiresAt}}{{if .Expired}}expired{{else}}expires{{end}} {{.Expires}}{{end}}
+<a href="#" data-action="edit" data-name="{{.Name}}" data-url="{{.URL}}">Edit</a>
+<a href="#" data-action="delete" data-name="{{.Name}}">Delete</a>
 </li>
 {{end}}
 </ul>
 </p>
+<p>
+{{if .prev}}<a href="{{.prev}}">Previous</a>{{end}}
+{{if .total}}{{.first}}-{{.last}} of {{.total}}{{end}}
+{{if .next}}<a href="{{.next}}">Next</a>{{end}}
+</p>
+</body>
+</html>
+`
+
+const jsRedirectPage = `
+<html>
+<head>
+<noscript><meta http-equiv="refresh" content="0; url={{.url}}"></noscript>
+<script type="text/javascript">
+var url = {{.url}};
+if (window.location.hash) {
+	url = url.replace(/#.*$/, '') + window.location.hash;
+}
+window.location.replace(url);
+</script>
+</head>
+<body>
+<a href="{{.url}}">{{.url}}</a>
+</body>
+</html>
+`
+
+const previewPage = `
+<html>
+<head>
+<meta property="og:title" content="{{.name}}">
+<meta property="og:url" content="{{.url}}">
+<meta property="og:description" content="{{.url}}">
+</head>
+<body>
+<a href="{{.url}}">{{.url}}</a>
+</body>
+</html>
+`
+
+const passwordPage = `
+<html>
+<head>
+<title>Password required</title>
+</head>
+<body>
+<form method="post">
+{{if .failed}}<p>Wrong password</p>{{end}}
+<input type="password" name="password" id="password" placeholder="password" autofocus>
+<input type="submit" value="Continue">
+</form>
+</body>
+</html>
+`
+
+const topPage = `
+<html>
+<head>
+<title>Top links</title>
+</head>
+<body>
+<ol>
+{{range .top}}
+<li>
+<a href="/{{.Name}}">{{.Name}}</a>
+<a href="{{.URL}}">{{.URL}}</a>
+{{.User}}
+{{.Hits}}
+</li>
+{{end}}
+</ol>
 </body>
 </html>
 `
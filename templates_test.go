@@ -4,6 +4,11 @@ package main
 
 import (
 	"html/template"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -15,3 +20,144 @@ func TestParseAdminPage(t *testing.T) {
 		t.Errorf("Error parsing template: %v", err)
 	}
 }
+
+func TestParseTopPage(t *testing.T) {
+	t.Parallel()
+
+	_, err := template.New("top").Parse(topPage)
+	if err != nil {
+		t.Errorf("Error parsing template: %v", err)
+	}
+}
+
+// renderTemplate executes the template with minimal admin page parameters.
+func renderTemplate(t *testing.T, tmpl *template.Template) string {
+	t.Helper()
+
+	var sb strings.Builder
+
+	err := tmpl.Execute(&sb, map[string]interface{}{
+		"path": "/_admin",
+		"user": "test",
+		"urls": []URL{},
+	})
+	checkErr(t, err)
+
+	return sb.String()
+}
+
+func TestLoadAdminTemplate(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	def := renderTemplate(t, loadAdminTemplate(""))
+
+	// missing file
+	if got := renderTemplate(t, loadAdminTemplate(filepath.Join(dir,
+		"missing.html"))); got != def {
+		t.Error("Missing template did not fall back to default:", got)
+	}
+
+	// broken file
+	broken := filepath.Join(dir, "broken.html")
+	checkErr(t, os.WriteFile(broken, []byte("{{range .urls}"), 0o600))
+
+	if got := renderTemplate(t, loadAdminTemplate(broken)); got != def {
+		t.Error("Broken template did not fall back to default:", got)
+	}
+
+	// working file
+	custom := filepath.Join(dir, "custom.html")
+	checkErr(t, os.WriteFile(custom, []byte("Hello, {{.user}}"), 0o600))
+
+	if got, want := renderTemplate(t, loadAdminTemplate(custom)),
+		"Hello, test"; got != want {
+		t.Errorf("Wrong template: got %s , want %s", got, want)
+	}
+}
+
+func TestAdminThemes(t *testing.T) {
+	t.Parallel()
+
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a.html")
+	b := filepath.Join(dir, "b.html")
+
+	checkErr(t, os.WriteFile(a, []byte("A {{.user}}"), 0o600))
+	checkErr(t, os.WriteFile(b, []byte("B {{.user}}"), 0o600))
+
+	themes := loadAdminThemes("", map[string]string{
+		"a.example.com": a,
+		"B.example.com": b,
+	})
+	def := renderTemplate(t, loadAdminTemplate(""))
+
+	testCases := []struct {
+		host, want string
+	}{
+		{"a.example.com", "A test"},
+		{"b.example.com:8080", "B test"},
+		{"c.example.com", def},
+	}
+
+	for _, tc := range testCases {
+		if got := renderTemplate(t, themes.forHost(tc.host)); got != tc.want {
+			t.Errorf("Wrong template for %s: got %s , want %s", tc.host,
+				got, tc.want)
+		}
+	}
+}
+
+func TestStaticHandler(t *testing.T) {
+	t.Parallel()
+
+	req := httptest.NewRequest(http.MethodGet, "/_static/admin.js", nil)
+
+	rr, body := testRequest(t, staticHandler("admin.js"), req, http.StatusOK)
+
+	if got := rr.Header().Get("Content-Type"); !strings.Contains(got,
+		"javascript") {
+		t.Error("Wrong content type:", got)
+	}
+
+	if !strings.Contains(body, "function deleteLink") ||
+		strings.Contains(body, "ActiveXObject") {
+		t.Error("Wrong script:", body)
+	}
+}
+
+func TestAdminPageScript(t *testing.T) {
+	t.Parallel()
+
+	var sb strings.Builder
+
+	checkErr(t, loadAdminTemplate("").Execute(&sb, map[string]interface{}{
+		"path":  "/_admin",
+		"user":  "test",
+		"csrf":  "token",
+		"nonce": "abc123",
+		"urls":  []URL{{Name: "foo", URL: cExampleCom}}, //nolint:exhaustruct
+	}))
+
+	page := sb.String()
+
+	for _, want := range []string{
+		`<script src="/_static/admin.js" nonce="abc123" defer></script>`,
+		`<meta name="csrf-token" content="token">`,
+		`data-action="delete" data-name="foo"`,
+	} {
+		if !strings.Contains(page, want) {
+			t.Errorf("Missing %s in admin page: %s", want, page)
+		}
+	}
+
+	if strings.Contains(page, "onclick") || strings.Contains(page,
+		"<script>") {
+		t.Error("Inline script in admin page:", page)
+	}
+
+	if csp := adminCSP("abc123"); !strings.Contains(csp,
+		"script-src 'nonce-abc123'") {
+		t.Error("Nonce missing from CSP:", csp)
+	}
+}
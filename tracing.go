@@ -0,0 +1,97 @@
+// Copyright © Paul Tötterman <paul.totterman@gmail.com>. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+)
+
+// tracerName is the instrumentation scope of the spans of this service.
+const tracerName = "urlredir"
+
+// newTracerProvider returns a tracer provider batching spans to the OTLP/HTTP
+// endpoint of c.
+func newTracerProvider(ctx context.Context, c *config) (
+	*sdktrace.TracerProvider, error,
+) {
+	exp, err := otlptracehttp.New(ctx,
+		otlptracehttp.WithEndpointURL(c.TracingEndpoint))
+	if err != nil {
+		return nil, fmt.Errorf("failed creating trace exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", c.ApplicationName)))
+	if err != nil {
+		return nil, fmt.Errorf("failed creating trace resource: %w", err)
+	}
+
+	return sdktrace.NewTracerProvider(sdktrace.WithBatcher(exp),
+		sdktrace.WithResource(res)), nil
+}
+
+// otelMiddleware traces requests with spans from tp, continuing the trace of
+// the caller if there is one. The span is passed on in the request context.
+func otelMiddleware(tp trace.TracerProvider) middleware {
+	tracer := tp.Tracer(tracerName)
+	prop := propagation.TraceContext{}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter,
+			r *http.Request,
+		) {
+			name := r.Pattern
+			if name == "" {
+				name = r.Method
+			}
+
+			ctx := prop.Extract(r.Context(),
+				propagation.HeaderCarrier(r.Header))
+			ctx, span := tracer.Start(ctx, name,
+				trace.WithSpanKind(trace.SpanKindServer),
+				trace.WithAttributes(
+					attribute.String("http.request.method", r.Method),
+					attribute.String("url.path", r.URL.Path),
+					attribute.String("request.id",
+						getRequestID(r.Context())),
+				))
+			defer span.End()
+
+			rec := &statusRecorder{ResponseWriter: w, status: 0, bytes: 0}
+
+			next.ServeHTTP(rec, r.WithContext(ctx))
+
+			if rec.status == 0 {
+				rec.status = http.StatusOK
+			}
+
+			span.SetAttributes(attribute.Int("http.response.status_code",
+				rec.status))
+
+			if rec.status >= http.StatusInternalServerError {
+				span.SetStatus(codes.Error, http.StatusText(rec.status))
+			}
+		})
+	}
+}
+
+// startSpan starts a span for the database operation op, as a child of the
+// span in ctx. Without one, e.g. with tracing disabled, the span does nothing.
+func startSpan(ctx context.Context, op string) (context.Context, trace.Span) {
+	return trace.SpanFromContext(ctx).TracerProvider().Tracer(tracerName).
+		Start(ctx, op, trace.WithSpanKind(trace.SpanKindClient),
+			trace.WithAttributes(
+				attribute.String("db.system", "postgresql"),
+				attribute.String("db.operation.name", op),
+			))
+}
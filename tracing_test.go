@@ -0,0 +1,136 @@
+// Copyright © Paul Tötterman <paul.totterman@gmail.com>. All rights reserved.
+
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+)
+
+// newTestTracerProvider returns a tracer provider recording spans in memory.
+func newTestTracerProvider(t *testing.T) (*sdktrace.TracerProvider,
+	*tracetest.InMemoryExporter,
+) {
+	t.Helper()
+
+	exp := tracetest.NewInMemoryExporter()
+	tp := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exp))
+
+	t.Cleanup(func() { checkErr(t, tp.Shutdown(context.Background())) })
+
+	return tp, exp
+}
+
+// findSpan returns the recorded span called name.
+func findSpan(t *testing.T, spans tracetest.SpanStubs,
+	name string,
+) tracetest.SpanStub {
+	t.Helper()
+
+	for _, span := range spans {
+		if span.Name == name {
+			return span
+		}
+	}
+
+	t.Fatalf("Missing span %s in %d spans", name, len(spans))
+
+	return tracetest.SpanStub{} //nolint:exhaustruct
+}
+
+// spanStatus returns the response status recorded in span, 0 if none.
+func spanStatus(span tracetest.SpanStub) int64 {
+	for _, attr := range span.Attributes {
+		if attr.Key == "http.response.status_code" {
+			return attr.Value.AsInt64()
+		}
+	}
+
+	return 0
+}
+
+func TestOtelMiddleware(t *testing.T) {
+	t.Parallel()
+
+	tp, exp := newTestTracerProvider(t)
+
+	mux := http.NewServeMux()
+	mux.Handle("GET /{name}", otelMiddleware(tp)(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			_, span := startSpan(r.Context(), "getRedirect")
+			span.End()
+
+			http.NotFound(w, r)
+		})))
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+	req.Header.Set("Traceparent",
+		"00-4bf92f3577b34da6a3ce929d0e0e4736-00f067aa0ba902b7-01")
+
+	testRequest(t, mux, req, http.StatusNotFound)
+
+	spans := exp.GetSpans()
+	server := findSpan(t, spans, "GET /{name}")
+	db := findSpan(t, spans, "getRedirect")
+
+	if got, want := server.Parent.TraceID().String(),
+		"4bf92f3577b34da6a3ce929d0e0e4736"; got != want ||
+		!server.Parent.IsRemote() {
+		t.Errorf("Trace of caller not continued: got %s , want %s", got,
+			want)
+	}
+
+	if db.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Error("DB span is not a child of the request span")
+	}
+
+	if got := spanStatus(server); got != http.StatusNotFound {
+		t.Error("Wrong status in span:", got)
+	}
+}
+
+func TestStartSpanWithoutTracing(t *testing.T) {
+	t.Parallel()
+
+	if _, span := startSpan(context.Background(),
+		"getRedirect"); span.IsRecording() {
+		t.Error("Span recorded without tracing")
+	}
+}
+
+func TestTracedRedirect(t *testing.T) {
+	t.Parallel()
+
+	if testing.Short() {
+		t.Skip("Skipping db tests in short mode.")
+	}
+
+	_, db := initDB(t)
+	tp, exp := newTestTracerProvider(t)
+
+	mw := chain{panicMiddleware, otelMiddleware(tp), dbMiddleware(db)}
+	mux := http.NewServeMux()
+	mux.Handle("GET /{name}", mw.applyE(redirHandler(
+		&config{}))) //nolint:exhaustruct
+
+	req := httptest.NewRequest(http.MethodGet, "/foo", nil)
+
+	testRequest(t, mux, req, http.StatusFound)
+
+	spans := exp.GetSpans()
+	server := findSpan(t, spans, "GET /{name}")
+	getRedirect := findSpan(t, spans, "getRedirect")
+
+	if getRedirect.Parent.SpanID() != server.SpanContext.SpanID() {
+		t.Error("DB span is not a child of the redirect span")
+	}
+
+	if got := spanStatus(server); got != http.StatusFound {
+		t.Error("Wrong status in span:", got)
+	}
+}
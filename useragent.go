@@ -0,0 +1,69 @@
+// Copyright © Paul Tötterman <paul.totterman@gmail.com>. All rights reserved.
+
+package main
+
+import (
+	"strings"
+)
+
+// Buckets of user agents that can't be classified.
+const (
+	agentOther   = "Other"
+	agentUnknown = "Unknown"
+)
+
+// agentRule classifies user agents containing token as name. The first
+// matching rule wins, so more specific tokens go first.
+type agentRule struct {
+	token, name string
+}
+
+var (
+	browserRules = []agentRule{
+		{"bot", "Bot"},
+		{"crawl", "Bot"},
+		{"spider", "Bot"},
+		{"curl/", "Bot"},
+		{"wget/", "Bot"},
+		{"edg/", "Edge"},
+		{"opr/", "Opera"},
+		{"firefox/", "Firefox"},
+		{"fxios/", "Firefox"},
+		{"crios/", "Chrome"},
+		{"chrome/", "Chrome"},
+		{"safari/", "Safari"},
+	}
+	osRules = []agentRule{
+		{"android", "Android"},
+		{"iphone", "iOS"},
+		{"ipad", "iOS"},
+		{"windows", "Windows"},
+		{"mac os x", "macOS"},
+		{"cros ", "ChromeOS"},
+		{"linux", "Linux"},
+	}
+)
+
+// classifyAgent returns the name of the first rule matching the lower case
+// agent, or agentOther.
+func classifyAgent(agent string, rules []agentRule) string {
+	for _, rule := range rules {
+		if strings.Contains(agent, rule.token) {
+			return rule.name
+		}
+	}
+
+	return agentOther
+}
+
+// parseUserAgent classifies a User-Agent header into a browser and an
+// operating system. Empty agents are agentUnknown, unrecognized ones
+// agentOther.
+func parseUserAgent(agent string) (string, string) {
+	agent = strings.ToLower(strings.TrimSpace(agent))
+	if agent == "" {
+		return agentUnknown, agentUnknown
+	}
+
+	return classifyAgent(agent, browserRules), classifyAgent(agent, osRules)
+}
@@ -0,0 +1,66 @@
+// Copyright © Paul Tötterman <paul.totterman@gmail.com>. All rights reserved.
+
+package main
+
+import (
+	"testing"
+)
+
+func TestParseUserAgent(t *testing.T) {
+	t.Parallel()
+
+	testCases := []struct {
+		agent, browser, os string
+	}{
+		{
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 " +
+				"(KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36",
+			"Chrome", "Windows",
+		},
+		{
+			"Mozilla/5.0 (Linux; Android 14; Pixel 8) AppleWebKit/537.36 " +
+				"(KHTML, like Gecko) Chrome/120.0.0.0 Mobile Safari/537.36",
+			"Chrome", "Android",
+		},
+		{
+			"Mozilla/5.0 (Windows NT 10.0; Win64; x64) AppleWebKit/537.36 " +
+				"(KHTML, like Gecko) Chrome/120.0.0.0 Safari/537.36 " +
+				"Edg/120.0.0.0",
+			"Edge", "Windows",
+		},
+		{
+			"Mozilla/5.0 (X11; Linux x86_64; rv:121.0) Gecko/20100101 " +
+				"Firefox/121.0",
+			"Firefox", "Linux",
+		},
+		{
+			"Mozilla/5.0 (Macintosh; Intel Mac OS X 14_2) " +
+				"AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 " +
+				"Safari/605.1.15",
+			"Safari", "macOS",
+		},
+		{
+			"Mozilla/5.0 (iPhone; CPU iPhone OS 17_2 like Mac OS X) " +
+				"AppleWebKit/605.1.15 (KHTML, like Gecko) Version/17.2 " +
+				"Mobile/15E148 Safari/604.1",
+			"Safari", "iOS",
+		},
+		{
+			"Mozilla/5.0 (compatible; Googlebot/2.1; " +
+				"+http://www.google.com/bot.html)",
+			"Bot", "Other",
+		},
+		{"curl/8.5.0", "Bot", "Other"},
+		{"testagent", "Other", "Other"},
+		{"", "Unknown", "Unknown"},
+		{"  ", "Unknown", "Unknown"},
+	}
+
+	for _, tc := range testCases {
+		if browser, os := parseUserAgent(tc.agent); browser != tc.browser ||
+			os != tc.os {
+			t.Errorf("Wrong classification for %q: got %s %s , want %s %s",
+				tc.agent, browser, os, tc.browser, tc.os)
+		}
+	}
+}